@@ -0,0 +1,110 @@
+package paperless
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strings"
+
+	util "github.com/kopoli/go-util"
+)
+
+// BarcodeDecoder decodes the barcodes and QR codes of a page image. The
+// command function creates the commands for external programs.
+type BarcodeDecoder interface {
+	Decode(page string, command func(args ...string) (*exec.Cmd, error)) ([]string, error)
+}
+
+var barcodeDecoders = map[string]BarcodeDecoder{}
+
+// RegisterBarcodeDecoder registers a decoder that is selected in the scripts
+// with the setting decoder=name of the @barcodes command
+func RegisterBarcodeDecoder(name string, d BarcodeDecoder) {
+	barcodeDecoders[name] = d
+}
+
+// BarcodeDecoders returns the names of the registered decoders
+func BarcodeDecoders() (ret []string) {
+	for name := range barcodeDecoders {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return
+}
+
+func init() {
+	RegisterBarcodeDecoder("zbar", ZbarDecoder{})
+	RegisterBuiltin("barcodes", 2, 3, builtinBarcodes)
+}
+
+// @barcodes [decoder=NAME] IMAGE CODEFILE decodes the barcodes and QR codes
+// of IMAGE and writes their values to CODEFILE one per line. The values are
+// also reported as the result "barcodes". The default decoder is zbar.
+func builtinBarcodes(s *Status, args []string, stdout io.Writer) error {
+	page, codefile, err := srcDst(s, args[len(args)-2:])
+	if err != nil {
+		return err
+	}
+
+	name := "zbar"
+	if len(args) == 3 {
+		kv := strings.SplitN(args[0], "=", 2)
+		if len(kv) != 2 || kv[0] != "decoder" {
+			return util.E.New("Invalid barcode setting: %s", args[0])
+		}
+		name = kv[1]
+	}
+	decoder, ok := barcodeDecoders[name]
+	if !ok {
+		return util.E.New("Barcode decoder \"%s\" not found", name)
+	}
+
+	codes, err := decoder.Decode(page, commandFunc(s))
+	if err != nil {
+		return util.E.Annotate(err, "Barcode decoder ", name, " failed")
+	}
+
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "# Barcode decoder %s: %d codes\n", name, len(codes))
+	}
+	data := strings.Join(codes, "\n")
+	if len(codes) > 0 {
+		s.SetResult("barcodes", data)
+		data += "\n"
+	}
+	return ioutil.WriteFile(codefile, []byte(data), 0644)
+}
+
+// ZbarDecoder runs the zbarimg command
+type ZbarDecoder struct{}
+
+func (z ZbarDecoder) Decode(page string, command func(args ...string) (*exec.Cmd, error)) (ret []string, err error) {
+	cmd, err := command("zbarimg", "--quiet", "--raw", page)
+	if err != nil {
+		return
+	}
+	out := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	// zbarimg exits with 4 if no codes were found
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 4 {
+		return nil, nil
+	}
+	if err != nil {
+		err = util.E.Annotate(err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return
+}
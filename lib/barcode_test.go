@@ -0,0 +1,208 @@
+package paperless
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pageDecoder decodes the lines starting with "CODE:" in the page file
+type pageDecoder struct{}
+
+func (pageDecoder) Decode(page string, command func(args ...string) (*exec.Cmd, error)) (ret []string, err error) {
+	data, err := ioutil.ReadFile(page)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CODE:") {
+			ret = append(ret, strings.TrimPrefix(line, "CODE:"))
+		}
+	}
+	return
+}
+
+// testPage returns a PNG header followed by the codes
+func testPage(codes ...string) []byte {
+	data := "\x89PNG\r\n\x1a\n"
+	for _, c := range codes {
+		data += "\nCODE:" + c
+	}
+	return []byte(data + "\n")
+}
+
+func Test_builtinBarcodes(t *testing.T) {
+	RegisterBarcodeDecoder("page", pageDecoder{})
+	defer delete(barcodeDecoders, "page")
+
+	dir, err := ioutil.TempDir("", "barcodes")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		page     []byte
+		script   string
+		want     string
+		wantCode string
+		wantErr  bool
+	}{
+		{"Codes", testPage("ASN0042", "https://example.com"),
+			"@barcodes decoder=page $input $output",
+			"ASN0042\nhttps://example.com\n", "ASN0042\nhttps://example.com", false},
+		{"No codes", testPage(), "@barcodes decoder=page $input $output", "", "", false},
+		{"Unknown decoder", testPage(), "@barcodes decoder=other $input $output", "", "", true},
+		{"Invalid setting", testPage(), "@barcodes page $input $output", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := filepath.Join(dir, "input")
+			output := filepath.Join(dir, "output")
+			err := ioutil.WriteFile(input, tt.page, 0644)
+			if err != nil {
+				t.Fatalf("Writing the page failed: %v", err)
+			}
+
+			ch, err := NewCmdChainScript(tt.script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			s := Status{Environment: ch.Environment, Log: &bytes.Buffer{}, Results: &Results{}}
+			s.Constants = map[string]string{"input": input, "output": output}
+			err = RunCmdChain(ch, &s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunCmdChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadFile(output)
+			if string(data) != tt.want {
+				t.Errorf("@barcodes wrote %q, want %q", data, tt.want)
+			}
+			if got := s.Results.Values()["barcodes"]; got != tt.wantCode {
+				t.Errorf("@barcodes result = %q, want %q", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestProcessConfig_barcodes(t *testing.T) {
+	conf := &ProcessConfig{
+		SeparatorCode: "PATCHT",
+		ASNPattern:    regexp.MustCompile(`^ASN(\d+)$`),
+	}
+	tests := []struct {
+		barcodes  string
+		asn       int
+		separator bool
+	}{
+		{"", 0, false},
+		{"ASN0042", 42, false},
+		{"https://example.com\nASN7", 7, false},
+		{"ASN0000\nASNx", 0, false},
+		{"PATCHT", 0, true},
+		{"other\nPATCHT", 0, true},
+		{"PATCHT2", 0, false},
+	}
+	for _, tt := range tests {
+		if got := conf.ASN(tt.barcodes); got != tt.asn {
+			t.Errorf("ASN(%q) = %d, want %d", tt.barcodes, got, tt.asn)
+		}
+		img := Image{Barcodes: tt.barcodes}
+		if got := conf.IsSeparator(&img); got != tt.separator {
+			t.Errorf("IsSeparator(%q) = %v, want %v", tt.barcodes, got, tt.separator)
+		}
+	}
+
+	empty := &ProcessConfig{}
+	if empty.ASN("ASN1") != 0 || empty.IsSeparator(&Image{Barcodes: ""}) {
+		t.Errorf("The barcodes should not be interpreted without the settings")
+	}
+}
+
+func TestSaveBatch(t *testing.T) {
+	RegisterBarcodeDecoder("page", pageDecoder{})
+	defer delete(barcodeDecoders, "page")
+
+	destdir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+	_, err = db.addScript(Script{Name: "default", Script: "@barcodes decoder=page $input $tmpCodes"}, "", "")
+	if err != nil {
+		t.Fatalf("Adding the script failed: %v", err)
+	}
+
+	conf := &ProcessConfig{
+		SeparatorCode: "PATCHT",
+		ASNPattern:    regexp.MustCompile(`^ASN(\d+)$`),
+	}
+	pages := []UploadPage{
+		{"1.png", testPage("ASN0001")},
+		{"2.png", testPage("page 2")},
+		{"sep1.png", testPage("PATCHT", "first")},
+		{"3.png", testPage("page 3")},
+		{"sep2.png", testPage("PATCHT", "second")},
+	}
+
+	images, err := SaveBatch(pages, "batch", "", time.Time{}, conf, db, destdir)
+	if err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	type page struct{ Id, Document, ASN int }
+	got := make([]page, len(images))
+	for i, img := range images {
+		got[i] = page{img.Id, img.Document, img.ASN}
+	}
+	compare(t, "SaveBatch() pages not expected", []page{{1, 1, 1}, {2, 1, 0}, {4, 4, 0}}, got)
+
+	stored, err := db.getImages(nil, &Search{Document: 1})
+	if err != nil || stored.ResultCount != 2 {
+		t.Errorf("The first document should have 2 pages: %d, %v", stored.ResultCount, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(destdir, "*original*"))
+	if len(files) != 3 {
+		t.Errorf("The separator sheets should be removed: %v", files)
+	}
+
+	// A failing page removes the whole batch
+	_, err = SaveBatch([]UploadPage{{"4.png", testPage("page 4")}, {"bad.txt", []byte("text")}},
+		"batch", "", time.Time{}, conf, db, destdir)
+	if err == nil {
+		t.Errorf("SaveBatch() should fail with an unsupported file")
+	}
+	all, _ := db.getImages(nil, nil)
+	if all.ResultCount != 3 {
+		t.Errorf("The failed batch should be removed, found %d images", all.ResultCount)
+	}
+
+	// The numbers are assigned in sequence and a used number is not reused
+	conf.AutoASN = true
+	images, err = SaveBatch([]UploadPage{{"5.png", testPage("page 5")}, {"6.png", testPage("ASN0001", "copy")}},
+		"batch", "", time.Time{}, conf, db, destdir)
+	if err != nil {
+		t.Fatalf("SaveBatch() with AutoASN error = %v", err)
+	}
+	got = make([]page, len(images))
+	for i, img := range images {
+		got[i] = page{img.Id, img.Document, img.ASN}
+	}
+	compare(t, "SaveBatch() with AutoASN pages not expected", []page{{7, 7, 2}, {8, 7, 3}}, got)
+	if !strings.Contains(images[1].ProcessLog, "already used by image 1") {
+		t.Errorf("The used number should be logged: %s", images[1].ProcessLog)
+	}
+}
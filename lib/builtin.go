@@ -0,0 +1,306 @@
+package paperless
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "github.com/kopoli/go-util"
+	"golang.org/x/image/bmp"
+)
+
+// BuiltinFunc implements a built-in command. The args are the expanded
+// arguments without the command name and the output redirection. Relative
+// paths are relative to the RootDir of the Status.
+type BuiltinFunc func(s *Status, args []string, stdout io.Writer) error
+
+type builtinCommand struct {
+	minArgs int
+	maxArgs int
+	run     BuiltinFunc
+}
+
+var builtins = map[string]builtinCommand{}
+
+// RegisterBuiltin registers a built-in command that is called from scripts
+// with @name. The command accepts from minArgs to maxArgs arguments. If
+// maxArgs is negative, the number of arguments is unlimited.
+func RegisterBuiltin(name string, minArgs, maxArgs int, f BuiltinFunc) {
+	builtins[name] = builtinCommand{minArgs, maxArgs, f}
+}
+
+// Builtins returns the names of the registered built-in commands with the @
+// prefix
+func Builtins() (ret []string) {
+	for name := range builtins {
+		ret = append(ret, "@"+name)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Builtin is a Link that runs a command implemented in Go. The first item of
+// Cmd is the name of the command with the @ prefix.
+type Builtin struct {
+	Cmd
+}
+
+func isBuiltin(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// Validate makes sure the command is registered and gets a proper number of
+// arguments
+func (b *Builtin) Validate(e *Environment) (err error) {
+	err = b.validateArgs(e)
+	if err != nil {
+		return
+	}
+
+	return b.validateCount()
+}
+
+// validateCount makes sure the command is registered and the number of
+// arguments is proper
+func (b *Builtin) validateCount() error {
+	cmd, ok := builtins[strings.TrimPrefix(b.Cmd.Cmd[0], "@")]
+	if !isBuiltin(b.Cmd.Cmd[0]) || !ok {
+		return util.E.New("built-in command \"%s\" not found", b.Cmd.Cmd[0])
+	}
+
+	count := len(b.Cmd.Cmd) - 1
+	if _, pos := getRedirectFile(">", b.Cmd.Cmd); pos > 0 {
+		count -= 2
+	}
+	if count < cmd.minArgs || (cmd.maxArgs >= 0 && count > cmd.maxArgs) {
+		return util.E.New("built-in command %s got %d arguments", b.Cmd.Cmd[0], count)
+	}
+
+	return nil
+}
+
+func (b *Builtin) Run(s *Status) (err error) {
+	err = b.Validate(&s.Environment)
+	if err != nil {
+		return
+	}
+
+	return b.execute(s, s.Log)
+}
+
+func (b *Builtin) execute(s *Status, output io.Writer) (err error) {
+	if s.Cache != nil {
+		return s.Cache.execute(&b.Cmd, s, output, b.run)
+	}
+	return b.run(s, output)
+}
+
+func (b *Builtin) run(s *Status, output io.Writer) (err error) {
+	args, output, fp, err := b.expandArgs(s, output)
+	if err != nil {
+		return
+	}
+	if fp != nil {
+		defer fp.Close()
+	}
+
+	if output == nil {
+		output = ioutil.Discard
+	}
+
+	cmd := builtins[strings.TrimPrefix(args[0], "@")]
+	return cmd.run(s, args[1:], output)
+}
+
+/// The built-in commands
+
+func init() {
+	RegisterBuiltin("copy", 2, 2, builtinCopy)
+	RegisterBuiltin("checksum", 1, 1, builtinChecksum)
+	RegisterBuiltin("write", 1, -1, builtinWrite)
+	RegisterBuiltin("convert", 2, 2, builtinConvert)
+	RegisterBuiltin("thumbnail", 3, 3, builtinThumbnail)
+}
+
+// @copy SRC DST copies the file SRC to DST
+func builtinCopy(s *Status, args []string, stdout io.Writer) error {
+	src, dst, err := srcDst(s, args)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+// @checksum FILE prints the checksum of FILE
+func builtinChecksum(s *Status, args []string, stdout io.Writer) error {
+	path, err := s.filePath(args[0], false)
+	if err != nil {
+		return err
+	}
+	sum, err := ChecksumFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, sum)
+	return err
+}
+
+// @write FILE TEXT... writes the TEXT arguments separated by spaces to FILE
+func builtinWrite(s *Status, args []string, stdout io.Writer) error {
+	path, err := s.filePath(args[0], true)
+	if err != nil {
+		return err
+	}
+	text := strings.Join(args[1:], " ") + "\n"
+	return ioutil.WriteFile(path, []byte(text), 0644)
+}
+
+// @convert SRC DST converts the image SRC to the format of DST's extension
+func builtinConvert(s *Status, args []string, stdout io.Writer) error {
+	src, dst, err := srcDst(s, args)
+	if err != nil {
+		return err
+	}
+	img, err := readImage(src)
+	if err != nil {
+		return err
+	}
+	return writeImage(dst, img)
+}
+
+// srcDst returns the paths of the source and destination arguments
+func srcDst(s *Status, args []string) (src, dst string, err error) {
+	src, err = s.filePath(args[0], false)
+	if err == nil {
+		dst, err = s.filePath(args[1], true)
+	}
+	return
+}
+
+// @thumbnail SRC DST WxH shrinks the image SRC to fit in WxH and writes it to
+// DST. Smaller images are not enlarged.
+func builtinThumbnail(s *Status, args []string, stdout io.Writer) error {
+	var w, h int
+	var err error
+	size := strings.Split(args[2], "x")
+	if len(size) == 2 {
+		w, err = strconv.Atoi(size[0])
+		if err == nil {
+			h, err = strconv.Atoi(size[1])
+		}
+	}
+	if len(size) != 2 || err != nil || w <= 0 || h <= 0 {
+		return util.E.New("Invalid thumbnail size: %s", args[2])
+	}
+
+	src, dst, err := srcDst(s, args)
+	if err != nil {
+		return err
+	}
+	img, err := readImage(src)
+	if err != nil {
+		return err
+	}
+
+	return writeImage(dst, shrinkImage(img, w, h))
+}
+
+func readImage(path string) (ret image.Image, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	ret, _, err = image.Decode(fp)
+	if err != nil {
+		err = util.E.Annotate(err, "Decoding image ", path, " failed")
+	}
+	return
+}
+
+// writeImage encodes the image in the format of the path's extension
+func writeImage(path string, img image.Image) (err error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		err = png.Encode(fp, img)
+	case ".gif":
+		err = gif.Encode(fp, img, nil)
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(fp, img, &jpeg.Options{Quality: 80})
+	case ".bmp":
+		err = bmp.Encode(fp, img)
+	default:
+		err = util.E.New("Unsupported image format for file %s", path)
+	}
+	return
+}
+
+// shrinkImage scales the image to fit in w x h by averaging the pixels
+func shrinkImage(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= w && sh <= h {
+		return img
+	}
+
+	// Keep the aspect ratio
+	if sw*h > sh*w {
+		h = sh * w / sw
+	} else {
+		w = sw * h / sh
+	}
+	if w == 0 {
+		w = 1
+	}
+	if h == 0 {
+		h = 1
+	}
+
+	ret := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*sh/h, b.Min.Y+(y+1)*sh/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*sw/w, b.Min.X+(x+1)*sw/w
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			ret.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return ret
+}
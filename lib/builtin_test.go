@@ -0,0 +1,97 @@
+package paperless
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltin_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     []string
+		allowed map[string]bool
+		wantErr bool
+	}{
+		{"Proper command", []string{"@copy", "a", "b"}, nil, false},
+		{"Unknown command", []string{"@not-found"}, nil, true},
+		{"Too few arguments", []string{"@copy", "a"}, nil, true},
+		{"Too many arguments", []string{"@copy", "a", "b", "c"}, nil, true},
+		{"Redirection is not an argument", []string{"@checksum", "a", ">", "b"}, nil, false},
+		{"Unlimited arguments", []string{"@write", "a", "b", "c", "d"}, nil, false},
+		{"Command is allowed", []string{"@copy", "a", "b"},
+			map[string]bool{"@copy": true}, false},
+		{"Command not allowed", []string{"@copy", "a", "b"},
+			map[string]bool{"copy": true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Builtin{Cmd{tt.cmd}}
+			e := &Environment{RootDir: "/", AllowedCommands: tt.allowed}
+			if err := b.Validate(e); (err != nil) != tt.wantErr {
+				t.Errorf("Builtin.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuiltinThumbnail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builtin")
+	if err != nil {
+		t.Fatalf("Creating a temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fp, err := os.Create(filepath.Join(dir, "in.png"))
+	if err != nil {
+		t.Fatalf("Creating the input image failed: %v", err)
+	}
+	png.Encode(fp, image.NewGray(image.Rect(0, 0, 400, 100)))
+	fp.Close()
+
+	ch, err := NewCmdChainScript(`
+@thumbnail $in $tmpThumb.png 200x200
+@copy $tmpThumb.png out.png
+$sum = @checksum out.png
+@write $out $sum`)
+	if err != nil {
+		t.Fatalf("NewCmdChainScript() error = %v", err)
+	}
+
+	s := Status{Environment: ch.Environment, Log: &bytes.Buffer{}}
+	s.Constants = map[string]string{
+		"in":  filepath.Join(dir, "in.png"),
+		"out": filepath.Join(dir, "sum.txt"),
+	}
+	s.AllowedCommands = map[string]bool{}
+	for _, name := range Builtins() {
+		s.AllowedCommands[name] = true
+	}
+
+	err = RunCmdChain(ch, &s)
+	if err != nil {
+		t.Fatalf("RunCmdChain() error = %v, log: %s", err, s.Log)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sum.txt"))
+	if err != nil || len(data) == 0 {
+		t.Errorf("The checksum was not written: %v", err)
+	}
+
+	thumb := filepath.Join(dir, "thumb.png")
+	err = builtinThumbnail(&Status{}, []string{s.Constants["in"], thumb, "200x200"}, nil)
+	if err != nil {
+		t.Fatalf("builtinThumbnail() error = %v", err)
+	}
+	img, err := readImage(thumb)
+	if err != nil {
+		t.Fatalf("Reading the thumbnail failed: %v", err)
+	}
+	if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 50 {
+		t.Errorf("Thumbnail size = %v, want 200x50", img.Bounds().Size())
+	}
+}
@@ -0,0 +1,409 @@
+package paperless
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/kopoli/go-util"
+)
+
+// StepCache stores the outputs of the commands of the chains. The key of a
+// command is made from its arguments, the checksum of the command's
+// executable and the checksums of the files given as arguments. On a hit the
+// output file and the standard output are restored instead of running the
+// command.
+//
+// The output file of a command is the one the dependency analysis sees: the
+// target of the redirection or the last argument with a constant. Commands
+// without an output file are not cached.
+type StepCache struct {
+	Dir string
+
+	// MaxSize is the maximum total size of the cached outputs in bytes.
+	// If it is 0, the size is not limited.
+	MaxSize int64
+
+	mutex sync.Mutex
+
+	// Checksums of the executables by path, size and modification time
+	tools map[string]string
+}
+
+// cacheMeta describes how a cache entry is restored
+type cacheMeta struct {
+	// Prefix is removed from the expanded output argument to get the file
+	// path, e.g. "pnm:"
+	Prefix string
+	Stdout bool
+
+	// Results the command reported
+	Results map[string]string
+}
+
+// formatPrefixRe matches the file format prefixes of ImageMagick
+var formatPrefixRe = regexp.MustCompile(`^[a-zA-Z0-9]+:`)
+
+// NewStepCache creates the cache directory if needed
+func NewStepCache(dir string, maxSize int64) (ret *StepCache, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, util.E.Annotate(err, "Creating the cache directory failed")
+	}
+	return &StepCache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+// argFile returns the path and the format prefix of the existing regular
+// file in the expanded argument or an empty path
+func argFile(rootdir, arg string) (path, prefix string) {
+	candidates := []string{""}
+	if p := formatPrefixRe.FindString(arg); p != "" {
+		candidates = append(candidates, p)
+	}
+	for _, p := range candidates {
+		path = PathAbs(rootdir, strings.TrimPrefix(arg, p))
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, p
+		}
+	}
+	return "", ""
+}
+
+// tool returns the checksum of the executable that runs the command
+func (sc *StepCache) tool(name string) (string, error) {
+	var path string
+	var err error
+	if isBuiltin(name) {
+		path, err = os.Executable()
+	} else {
+		path, err = exec.LookPath(name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sum, ok := sc.tools[id]; ok {
+		return sum, nil
+	}
+	sum, err := ChecksumFile(path)
+	if err != nil {
+		return "", err
+	}
+	if sc.tools == nil {
+		sc.tools = map[string]string{}
+	}
+	sc.tools[id] = sum
+	return sum, nil
+}
+
+// key returns the cache key of the command. The temporary files are in the
+// key by their constant names as their paths change on each run.
+func (sc *StepCache) key(c *Cmd, s *Status) (string, error) {
+	symbolic := make(map[string]string, len(s.Constants))
+	for k, v := range s.Constants {
+		symbolic[k] = v
+	}
+	for _, name := range s.TempFiles {
+		symbolic[name] = "$" + name
+	}
+
+	tool, err := sc.tool(c.Cmd[0])
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "tool %s\n", tool)
+	for _, a := range c.Cmd {
+		fmt.Fprintf(h, "arg %q\n", expandConsts(a, symbolic))
+	}
+
+	_, redir := getRedirectFile(">", c.Cmd)
+	for i, a := range c.Cmd {
+		if redir > 0 && (i == redir || i == redir+1) {
+			continue
+		}
+		arg, err := expandConstsStrict(a, s.Constants)
+		if err != nil {
+			return "", err
+		}
+		if path, _ := argFile(s.RootDir, arg); path != "" {
+			sum, err := ChecksumFile(path)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "input %d %s\n", i, sum)
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// execute runs the command with the run function unless its outputs are in
+// the cache
+func (sc *StepCache) execute(c *Cmd, s *Status, output io.Writer,
+	run func(*Status, io.Writer) error) (err error) {
+
+	out := c.outputArg()
+	if out < 0 {
+		return run(s, output)
+	}
+
+	key, err := sc.key(c, s)
+	if err != nil {
+		// The error is reported when running the command
+		return run(s, output)
+	}
+
+	ok, err := sc.restore(key, c, s, out, output)
+	if err != nil && s.Log != nil {
+		fmt.Fprintln(s.Log, "# Restoring from the cache failed:", err)
+	}
+	if ok {
+		return nil
+	}
+
+	_, redir := getRedirectFile(">", c.Cmd)
+	stdout := &bytes.Buffer{}
+	if redir == 0 {
+		if output != nil {
+			output = io.MultiWriter(output, stdout)
+		} else {
+			output = stdout
+		}
+	}
+
+	// The results of the command are collected separately for storing
+	rs := *s
+	rs.Results = &Results{}
+	err = run(&rs, output)
+	results := rs.Results.Values()
+	for k, v := range results {
+		s.SetResult(k, v)
+	}
+	if err != nil {
+		return
+	}
+
+	meta := cacheMeta{Stdout: redir == 0, Results: results}
+	e2 := sc.store(key, c, s, out, stdout.Bytes(), meta)
+	if e2 != nil && s.Log != nil {
+		fmt.Fprintln(s.Log, "# Storing to the cache failed:", e2)
+	}
+	return
+}
+
+func (sc *StepCache) restore(key string, c *Cmd, s *Status, out int, output io.Writer) (bool, error) {
+	dir := filepath.Join(sc.Dir, key)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "meta"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var meta cacheMeta
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return false, err
+	}
+
+	arg, err := expandConstsStrict(c.Cmd[out], s.Constants)
+	if err != nil {
+		return false, err
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "output"))
+	if err != nil {
+		return false, err
+	}
+	path, err := s.filePath(strings.TrimPrefix(arg, meta.Prefix), true)
+	if err != nil {
+		return false, err
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	if meta.Stdout {
+		data, err = ioutil.ReadFile(filepath.Join(dir, "stdout"))
+		if err != nil {
+			return false, err
+		}
+		if output != nil {
+			_, err = output.Write(data)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for k, v := range meta.Results {
+		s.SetResult(k, v)
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(dir, now, now)
+
+	if s.Log != nil {
+		args := make([]string, len(c.Cmd))
+		for i := range c.Cmd {
+			args[i] = expandConsts(c.Cmd[i], s.Constants)
+		}
+		fmt.Fprintln(s.Log, "# Restored from the cache:", strings.Join(args, " "))
+	}
+	return true, nil
+}
+
+func (sc *StepCache) store(key string, c *Cmd, s *Status, out int, stdout []byte, meta cacheMeta) error {
+	arg, err := expandConstsStrict(c.Cmd[out], s.Constants)
+	if err != nil {
+		return err
+	}
+	path, prefix := argFile(s.RootDir, arg)
+	meta.Prefix = prefix
+	if path == "" {
+		// The command did not write the output file
+		return nil
+	}
+
+	tmpdir, err := ioutil.TempDir(sc.Dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpdir, "output"), data, 0644)
+	if err != nil {
+		return err
+	}
+	if meta.Stdout {
+		err = ioutil.WriteFile(filepath.Join(tmpdir, "stdout"), stdout, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	data, err = json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpdir, "meta"), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Another run may have stored the same entry already
+	if os.Rename(tmpdir, filepath.Join(sc.Dir, key)) != nil {
+		return nil
+	}
+
+	return sc.trim()
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (sc *StepCache) entries() (ret []cacheEntry, err error) {
+	infos, err := ioutil.ReadDir(sc.Dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		e := cacheEntry{filepath.Join(sc.Dir, info.Name()), 0, info.ModTime()}
+		files, _ := ioutil.ReadDir(e.path)
+		for _, f := range files {
+			e.size += f.Size()
+		}
+		ret = append(ret, e)
+	}
+	return
+}
+
+// trim removes the least recently used entries until the cache fits in
+// MaxSize
+func (sc *StepCache) trim() error {
+	if sc.MaxSize <= 0 {
+		return nil
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	entries, err := sc.entries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	for i := 0; total > sc.MaxSize && i < len(entries); i++ {
+		err = os.RemoveAll(entries[i].path)
+		if err != nil {
+			return err
+		}
+		total -= entries[i].size
+	}
+	return nil
+}
+
+// Purge removes all the entries from the cache
+func (sc *StepCache) Purge() error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(sc.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ret := util.NewErrorList("Purging the cache failed")
+	for _, info := range infos {
+		err = os.RemoveAll(filepath.Join(sc.Dir, info.Name()))
+		if err != nil {
+			ret.Append(err)
+		}
+	}
+
+	if ret.IsEmpty() {
+		return nil
+	}
+	return ret
+}
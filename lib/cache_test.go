@@ -0,0 +1,93 @@
+package paperless
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStepCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stepcache")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sc, err := NewStepCache(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatalf("NewStepCache() error = %v", err)
+	}
+	input := filepath.Join(dir, "input")
+	output := filepath.Join(dir, "output")
+
+	script := "cat $input > $tmpA\n$a = cat $tmpA\n@write $output $a"
+	run := func(text string) string {
+		err := ioutil.WriteFile(input, []byte(text), 0644)
+		if err != nil {
+			t.Fatalf("Writing the input failed: %v", err)
+		}
+		ch, err := NewCmdChainScript(script)
+		if err != nil {
+			t.Fatalf("NewCmdChainScript() error = %v", err)
+		}
+		buf := &bytes.Buffer{}
+		s := Status{Environment: ch.Environment, Log: buf}
+		s.Constants = map[string]string{"input": input, "output": output}
+		s.Cache = sc
+		err = RunCmdChain(ch, &s)
+		if err != nil {
+			t.Fatalf("RunCmdChain() error = %v, log: %s", err, buf.String())
+		}
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Reading the output failed: %v", err)
+		}
+		if string(data) != text+"\n" {
+			t.Errorf("Output = %q, want %q", data, text+"\n")
+		}
+		return buf.String()
+	}
+
+	if log := run("first"); strings.Contains(log, "# Restored") {
+		t.Errorf("The first run should not restore from the cache: %s", log)
+	}
+	log := run("first")
+	if strings.Count(log, "# Restored from the cache:") != 2 {
+		t.Errorf("The second run should restore the outputs of both commands: %s", log)
+	}
+	if strings.Contains(log, "# Running command: cat") {
+		t.Errorf("The second run should not run the cached commands: %s", log)
+	}
+	if log := run("second"); strings.Contains(log, "# Restored") {
+		t.Errorf("A changed input should not restore from the cache: %s", log)
+	}
+
+	entries, err := sc.entries()
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("Expected cache entries, got %d (%v)", len(entries), err)
+	}
+
+	sc.MaxSize = 1
+	err = sc.trim()
+	if err != nil {
+		t.Fatalf("StepCache.trim() error = %v", err)
+	}
+	entries, _ = sc.entries()
+	if len(entries) != 0 {
+		t.Errorf("Expected the cache to be trimmed, got %d entries", len(entries))
+	}
+
+	sc.MaxSize = 0
+	run("third")
+	err = sc.Purge()
+	if err != nil {
+		t.Fatalf("StepCache.Purge() error = %v", err)
+	}
+	entries, _ = sc.entries()
+	if len(entries) != 0 {
+		t.Errorf("Expected the cache to be empty, got %d entries", len(entries))
+	}
+}
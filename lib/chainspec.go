@@ -0,0 +1,345 @@
+package paperless
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	util "github.com/kopoli/go-util"
+	"gopkg.in/yaml.v2"
+)
+
+// ChainSpec is the structured form of a CmdChain. It can be converted to and
+// from the script text and serialized as JSON or YAML. Unknown fields are
+// errors when decoding either.
+type ChainSpec struct {
+	// Params are the declared parameters with their default values
+	Params map[string]string `json:"Params,omitempty" yaml:"Params,omitempty"`
+
+	// Constants and TempFiles are the constants the links refer to but do
+	// not define. They are derived from the links and ignored when a
+	// CmdChain is created from the spec.
+	Constants []string `json:"Constants,omitempty" yaml:"Constants,omitempty"`
+	TempFiles []string `json:"TempFiles,omitempty" yaml:"TempFiles,omitempty"`
+
+	Links []LinkSpec `json:"Links" yaml:"Links"`
+}
+
+// LinkSpec is a single line of a script
+type LinkSpec struct {
+	// Optional link's failure is logged and the chain continues
+	Optional bool `json:"Optional,omitempty" yaml:"Optional,omitempty"`
+
+	// Timeout is the duration, such as "30s", after which the commands of
+	// the link are killed
+	Timeout string `json:"Timeout,omitempty" yaml:"Timeout,omitempty"`
+
+	// IfExists is a file that must exist and be non-empty for the link to
+	// be run
+	IfExists string `json:"IfExists,omitempty" yaml:"IfExists,omitempty"`
+
+	// Capture is the name of the constant the output of the command is
+	// stored to
+	Capture string `json:"Capture,omitempty" yaml:"Capture,omitempty"`
+
+	// Commands are the alternatives of the link. The next one is run only
+	// if the previous one fails.
+	Commands []CommandSpec `json:"Commands" yaml:"Commands"`
+}
+
+// CommandSpec is a command with its arguments
+type CommandSpec struct {
+	Argv []string `json:"Argv" yaml:"Argv"`
+
+	// Redirect is the file the standard output is written to
+	Redirect string `json:"Redirect,omitempty" yaml:"Redirect,omitempty"`
+}
+
+// Spec returns the structured form of the chain
+func (c *CmdChain) Spec() (ret ChainSpec, err error) {
+	if len(c.Params) > 0 {
+		ret.Params = make(map[string]string, len(c.Params))
+		for k, v := range c.Params {
+			ret.Params[k] = v
+		}
+	}
+
+	tmp := map[string]bool{}
+	for _, name := range c.TempFiles {
+		tmp[name] = true
+		ret.TempFiles = append(ret.TempFiles, name)
+	}
+	for name := range c.Constants {
+		if !tmp[name] {
+			ret.Constants = append(ret.Constants, name)
+		}
+	}
+	sort.Strings(ret.Constants)
+
+	ret.Links = []LinkSpec{}
+	for i, l := range c.Links {
+		var ls LinkSpec
+		ls, err = linkSpec(l)
+		if err != nil {
+			err = util.E.Annotate(err, "link ", i+1)
+			return
+		}
+		ret.Links = append(ret.Links, ls)
+	}
+	return
+}
+
+func linkSpec(l Link) (ret LinkSpec, err error) {
+unwrap:
+	for {
+		switch v := l.(type) {
+		case *Optional:
+			if ret.Optional {
+				return ret, util.E.New("nested optional links are not supported")
+			}
+			ret.Optional = true
+			l = v.Link
+		case *Guard:
+			if ret.IfExists != "" {
+				return ret, util.E.New("nested conditions are not supported")
+			}
+			ret.IfExists = v.Path
+			l = v.Link
+		case *Timeout:
+			if ret.Timeout != "" {
+				return ret, util.E.New("nested timeouts are not supported")
+			}
+			ret.Timeout = v.Duration.String()
+			l = v.Link
+		default:
+			break unwrap
+		}
+	}
+
+	alternatives := []Link{l}
+	if f, ok := l.(*Fallback); ok {
+		alternatives = f.Links
+	}
+
+	for i, a := range alternatives {
+		capture := ""
+		if c, ok := a.(*Capture); ok {
+			capture = c.Name
+			a = c.Cmd
+		}
+		if i == 0 {
+			ret.Capture = capture
+		} else if capture != ret.Capture {
+			return ret, util.E.New("the alternatives must capture to the same constant")
+		}
+
+		var args []string
+		switch v := a.(type) {
+		case *Cmd:
+			args = v.Cmd
+		case *Builtin:
+			args = v.Cmd.Cmd
+		default:
+			return ret, util.E.New("unsupported link type %T", a)
+		}
+
+		cs := CommandSpec{}
+		file, pos := getRedirectFile(">", args)
+		if file != "" {
+			cs.Redirect = file
+			cs.Argv = append(append([]string{}, args[:pos]...), args[pos+2:]...)
+		} else {
+			cs.Argv = append([]string{}, args...)
+		}
+		ret.Commands = append(ret.Commands, cs)
+	}
+	return
+}
+
+// Script returns the script text of the spec
+func (s *ChainSpec) Script() (string, error) {
+	buf := &bytes.Buffer{}
+
+	var names []string
+	for name := range s.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !wordRe.MatchString(name) || !paramValueRe.MatchString(s.Params[name]) {
+			return "", util.E.New("invalid parameter %s=%s", name, s.Params[name])
+		}
+		buf.WriteString("# param " + name + "=" + s.Params[name] + "\n")
+	}
+
+	for i := range s.Links {
+		line, err := s.Links[i].line()
+		if err != nil {
+			return "", util.E.Annotate(err, "link ", i+1)
+		}
+		buf.WriteString(line + "\n")
+	}
+	return buf.String(), nil
+}
+
+// line returns the script line of the link
+func (l *LinkSpec) line() (string, error) {
+	var parts []string
+	add := func(arg string, first bool) error {
+		q, err := quoteArg(arg, first)
+		parts = append(parts, q)
+		return err
+	}
+
+	if len(l.Commands) == 0 {
+		return "", util.E.New("a link requires a command")
+	}
+	if l.Optional {
+		parts = append(parts, "-")
+	}
+	if l.Timeout != "" {
+		d, err := time.ParseDuration(l.Timeout)
+		if err != nil || d <= 0 {
+			return "", util.E.New("invalid timeout %s", l.Timeout)
+		}
+		parts = append(parts, "timeout", d.String())
+	}
+	if l.IfExists != "" {
+		parts = append(parts, "if", "exists")
+		if err := add(l.IfExists, false); err != nil {
+			return "", err
+		}
+	}
+	if l.Capture != "" {
+		if !wordRe.MatchString(l.Capture) {
+			return "", util.E.New("invalid capture constant name %s", l.Capture)
+		}
+		parts = append(parts, "$"+l.Capture, "=")
+	}
+
+	for i, c := range l.Commands {
+		if i > 0 {
+			parts = append(parts, "||")
+		}
+		if len(c.Argv) == 0 {
+			return "", util.E.New("a command requires arguments")
+		}
+		if len(c.Argv) > 1 && c.Argv[1] == "=" && constNameRe.MatchString(c.Argv[0]) {
+			return "", util.E.New("the command %s cannot be represented", c.Argv[0])
+		}
+		for k, a := range c.Argv {
+			if err := add(a, k == 0); err != nil {
+				return "", err
+			}
+		}
+		if c.Redirect != "" {
+			parts = append(parts, ">")
+			if err := add(c.Redirect, false); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// quoteArg quotes the argument for a script line if necessary. It is an error
+// if the argument cannot be represented in the script syntax.
+func quoteArg(arg string, first bool) (string, error) {
+	switch {
+	case arg == "":
+		return "", util.E.New("empty arguments cannot be represented")
+	case arg == "||" || arg == ">":
+		return "", util.E.New("the argument %s cannot be represented", arg)
+	case strings.ContainsAny(arg, "#\n"):
+		return "", util.E.New("the argument %q cannot be represented", arg)
+	case first && (strings.HasPrefix(arg, "-") || arg == "if" || arg == "timeout"):
+		return "", util.E.New("the command %s cannot be represented", arg)
+	}
+
+	plain := true
+	for _, r := range arg {
+		if unicode.IsSpace(r) || unicode.In(r, unicode.Quotation_Mark) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return arg, nil
+	}
+
+	for _, q := range []string{`"`, `'`} {
+		if !strings.Contains(arg, q) {
+			return q + arg + q, nil
+		}
+	}
+	return "", util.E.New("the argument %s cannot be quoted", arg)
+}
+
+// NewCmdChainSpec creates a CmdChain from the structured form
+func NewCmdChainSpec(spec ChainSpec) (c *CmdChain, err error) {
+	script, err := spec.Script()
+	if err != nil {
+		return
+	}
+	return NewCmdChainScript(script)
+}
+
+// ScriptSpec returns the structured form of the script text
+func ScriptSpec(script string) (ret ChainSpec, err error) {
+	ch, err := NewCmdChainScript(script)
+	if err != nil {
+		return
+	}
+	return ch.Spec()
+}
+
+// Script returns the script text of the chain
+func (c *CmdChain) Script() (string, error) {
+	spec, err := c.Spec()
+	if err != nil {
+		return "", err
+	}
+	return spec.Script()
+}
+
+// MarshalJSON encodes the chain as a ChainSpec
+func (c *CmdChain) MarshalJSON() ([]byte, error) {
+	spec, err := c.Spec()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// UnmarshalJSON decodes the chain from a ChainSpec
+func (c *CmdChain) UnmarshalJSON(data []byte) error {
+	var spec ChainSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&spec)
+	if err != nil {
+		return err
+	}
+
+	ch, err := NewCmdChainSpec(spec)
+	if err != nil {
+		return err
+	}
+	*c = *ch
+	return nil
+}
+
+// YAML returns the spec in YAML
+func (s *ChainSpec) YAML() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+// ParseChainSpecYAML parses the spec from YAML
+func ParseChainSpecYAML(data []byte) (ret ChainSpec, err error) {
+	err = yaml.UnmarshalStrict(data, &ret)
+	return
+}
@@ -0,0 +1,174 @@
+package paperless
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const specTestScript = `# param lang=fin
+timeout 30s echo $input > $tmpA
+- if exists $tmpA $b = cat $tmpA || echo "two words" 'say "hi"'
+@write $contents ${lang:-eng} $b
+`
+
+func TestCmdChain_Spec(t *testing.T) {
+	ch, err := NewCmdChainScript(specTestScript)
+	if err != nil {
+		t.Fatalf("NewCmdChainScript() error = %v", err)
+	}
+
+	spec, err := ch.Spec()
+	if err != nil {
+		t.Fatalf("CmdChain.Spec() error = %v", err)
+	}
+	want := ChainSpec{
+		Params:    map[string]string{"lang": "fin"},
+		Constants: []string{"contents", "input"},
+		TempFiles: []string{"tmpA"},
+		Links: []LinkSpec{
+			{Timeout: "30s", Commands: []CommandSpec{{Argv: []string{"echo", "$input"}, Redirect: "$tmpA"}}},
+			{Optional: true, IfExists: "$tmpA", Capture: "b", Commands: []CommandSpec{
+				{Argv: []string{"cat", "$tmpA"}},
+				{Argv: []string{"echo", "two words", `say "hi"`}},
+			}},
+			{Commands: []CommandSpec{{Argv: []string{"@write", "$contents", "${lang:-eng}", "$b"}}}},
+		},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Fatalf("CmdChain.Spec() = %#v, want %#v", spec, want)
+	}
+
+	encodings := []struct {
+		name   string
+		decode func(ChainSpec) (ChainSpec, error)
+	}{
+		{"Script", func(s ChainSpec) (ret ChainSpec, err error) {
+			ch, err := NewCmdChainSpec(s)
+			if err != nil {
+				return
+			}
+			return ch.Spec()
+		}},
+		{"JSON", func(s ChainSpec) (ret ChainSpec, err error) {
+			ch, err := NewCmdChainSpec(s)
+			if err != nil {
+				return
+			}
+			data, err := json.Marshal(ch)
+			if err != nil {
+				return
+			}
+			var ch2 CmdChain
+			err = json.Unmarshal(data, &ch2)
+			if err != nil {
+				return
+			}
+			return ch2.Spec()
+		}},
+		{"YAML", func(s ChainSpec) (ChainSpec, error) {
+			data, err := s.YAML()
+			if err != nil {
+				return ChainSpec{}, err
+			}
+			return ParseChainSpecYAML(data)
+		}},
+	}
+	for _, tt := range encodings {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decode(want)
+			if err != nil {
+				t.Fatalf("decoding failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round-trip = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestChainSpec_Script(t *testing.T) {
+	cmd := func(argv ...string) []LinkSpec {
+		return []LinkSpec{{Commands: []CommandSpec{{Argv: argv}}}}
+	}
+	tests := []struct {
+		name    string
+		spec    ChainSpec
+		want    string
+		wantErr bool
+	}{
+		{"Quoting", ChainSpec{Links: cmd("echo", "a b", `"c"`)},
+			"echo \"a b\" '\"c\"'\n", false},
+		{"Empty argument", ChainSpec{Links: cmd("echo", "")}, "", true},
+		{"Comment character", ChainSpec{Links: cmd("echo", "#")}, "", true},
+		{"Both quotes", ChainSpec{Links: cmd("echo", `"'`)}, "", true},
+		{"Command starting with a dash", ChainSpec{Links: cmd("-echo")}, "", true},
+		{"No commands", ChainSpec{Links: []LinkSpec{{}}}, "", true},
+		{"Timeout", ChainSpec{Links: []LinkSpec{{Timeout: "90s", Commands: []CommandSpec{{Argv: []string{"true"}}}}}},
+			"timeout 1m30s true\n", false},
+		{"Invalid timeout", ChainSpec{Links: []LinkSpec{{Timeout: "soon", Commands: []CommandSpec{{Argv: []string{"true"}}}}}},
+			"", true},
+		{"Command named timeout", ChainSpec{Links: cmd("timeout", "10", "true")}, "", true},
+		{"Invalid parameter", ChainSpec{Params: map[string]string{"a": "b c"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.Script()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ChainSpec.Script() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ChainSpec.Script() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChainSpecYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    ChainSpec
+		wantErr bool
+	}{
+		{"Block style", `
+# A comment
+Params:
+  lang: fin
+Links:
+- Commands:
+  - Argv:
+    - tesseract
+    - '-l'
+    - $lang   # trailing comment
+    Redirect: "$contents"
+- Optional: true
+  Timeout: 10s
+  Commands:
+    - Argv: [echo, 'it''s', "a # b"]
+`, ChainSpec{
+			Params: map[string]string{"lang": "fin"},
+			Links: []LinkSpec{
+				{Commands: []CommandSpec{{Argv: []string{"tesseract", "-l", "$lang"}, Redirect: "$contents"}}},
+				{Optional: true, Timeout: "10s", Commands: []CommandSpec{{Argv: []string{"echo", "it's", "a # b"}}}},
+			},
+		}, false},
+		{"Unknown field", "Links: []\nOther: 1\n", ChainSpec{}, true},
+		{"Bad indentation", "Links:\n  - Commands: []\n   Optional: true\n", ChainSpec{}, true},
+		{"Unterminated quote", "Links: [\"a]\n", ChainSpec{}, true},
+		{"Block scalar", "Links: |\n  a\n", ChainSpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChainSpecYAML([]byte(tt.yaml))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseChainSpecYAML() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChainSpecYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
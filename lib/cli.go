@@ -3,6 +3,7 @@ package paperless
 import (
 	"fmt"
 	"runtime"
+	"strconv"
 
 	"github.com/jawher/mow.cli"
 	util "github.com/kopoli/go-util"
@@ -23,6 +24,39 @@ func Cli(opts util.Options, args []string) error {
 		"Directory to save the images in")
 	optListenAddr := app.StringOpt("a address", ":8078", "Listen address and port")
 
+	optPolicy := app.StringOpt("command-policy", "",
+		"File of the policy for the commands and arguments of the processing scripts")
+	optSandbox := app.BoolOpt("sandbox", false,
+		"Run the processing commands in a sandbox (requires bwrap and prlimit)")
+	optSandboxCPU := app.IntOpt("sandbox-cpu", 300,
+		"Maximum CPU time of a sandboxed command in seconds")
+	optSandboxMemory := app.IntOpt("sandbox-memory", 2048,
+		"Maximum memory of a sandboxed command in MiB")
+	optSandboxOutput := app.IntOpt("sandbox-output", 256,
+		"Maximum output size of a sandboxed command in MiB")
+
+	optCacheDir := app.StringOpt("cache-dir", "",
+		"Directory to cache the outputs of the processing commands in. Disabled if empty.")
+	optCacheSize := app.IntOpt("cache-size", 1024,
+		"Maximum size of the command output cache in MiB. Unlimited if 0.")
+	optCachePurge := app.BoolOpt("cache-purge", false,
+		"Remove the cached command outputs and exit")
+
+	optMaxParallel := app.IntOpt("max-parallel", 0,
+		"Maximum number of the commands of a script run at the same time. 0 is the number of CPUs.")
+
+	optReviewThreshold := app.IntOpt("review-threshold", 60,
+		"Images whose OCR confidence is below this (0-100) need a review")
+
+	optSeparatorCode := app.StringOpt("separator-code", "PATCHT",
+		"Barcode of the separator sheets that split a batch upload. Disabled if empty.")
+	optASNPattern := app.StringOpt("asn-pattern", `^ASN(\d+)$`,
+		"Regexp of the barcodes of the archive serial numbers. The first group is the number.")
+	optASNAuto := app.BoolOpt("asn-auto", true,
+		"Assign the next archive serial number to the uploaded images without one. Disabled with --asn-auto=false.")
+	optBlankPages := app.StringOpt("blank-pages", BlankPagesKeep,
+		"How the blank pages of the uploads are handled: keep, skip or reject")
+
 	optPrintRoutes := app.BoolOpt("print-routes", false,
 		"A debug option to print the REST API")
 
@@ -31,6 +65,35 @@ func Cli(opts util.Options, args []string) error {
 		opts.Set("image-directory", *optImageDir)
 		opts.Set("listen-address", *optListenAddr)
 
+		if *optPolicy != "" {
+			opts.Set("command-policy", *optPolicy)
+		}
+		if *optSandbox {
+			opts.Set("sandbox", "t")
+		}
+		opts.Set("sandbox-cpu", strconv.Itoa(*optSandboxCPU))
+		opts.Set("sandbox-memory", strconv.Itoa(*optSandboxMemory))
+		opts.Set("sandbox-output", strconv.Itoa(*optSandboxOutput))
+
+		if *optCacheDir != "" {
+			opts.Set("cache-dir", *optCacheDir)
+		}
+		opts.Set("cache-size", strconv.Itoa(*optCacheSize))
+		if *optCachePurge {
+			opts.Set("cache-purge", "t")
+		}
+
+		opts.Set("max-parallel", strconv.Itoa(*optMaxParallel))
+		opts.Set("review-threshold", strconv.Itoa(*optReviewThreshold))
+		opts.Set("separator-code", *optSeparatorCode)
+		if *optASNPattern != "" {
+			opts.Set("asn-pattern", *optASNPattern)
+		}
+		if *optASNAuto {
+			opts.Set("asn-auto", "t")
+		}
+		opts.Set("blank-pages", *optBlankPages)
+
 		if *optPrintRoutes {
 			opts.Set("print-routes", "t")
 		}
@@ -1,6 +1,8 @@
 package paperless
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +10,8 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
 	"github.com/kopoli/go-util"
@@ -29,10 +33,27 @@ type Environment struct {
 	// temporary directory
 	RootDir string
 
+	// Inputs and Outputs are the constants of the files outside RootDir
+	// the commands may read and write when they are sandboxed
+	Inputs  []string
+	Outputs []string
+
 	// AllowedCommands contain the commands that are allowed. If this is
 	// nil, all commands are allowed.
 	AllowedCommands map[string]bool
 
+	// Sandbox restricts the commands. If this is nil, the commands are
+	// run without restrictions.
+	Sandbox *Sandbox
+
+	// Policy restricts the arguments of the commands. If this is nil,
+	// all arguments are allowed.
+	Policy *Policy
+
+	// Cache stores the outputs of the commands. If this is nil, the
+	// commands are always run.
+	Cache *StepCache
+
 	initialized bool
 }
 
@@ -113,7 +134,63 @@ type Status struct {
 	// The log output will be written to this
 	Log io.Writer
 
+	// Results collects the values the commands report about the
+	// document. If this is nil, the values are discarded.
+	Results *Results
+
 	Environment
+
+	// ctx is done when the timeout of the running link expires
+	ctx context.Context
+}
+
+// runContext returns the context the commands are run with
+func (s *Status) runContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// SetResult reports a value about the document
+func (s *Status) SetResult(name, value string) {
+	if s.Results != nil {
+		s.Results.Set(name, value)
+	}
+}
+
+// Results are the values reported by the commands. It is safe for
+// concurrent use.
+type Results struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func (r *Results) Set(name, value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.values == nil {
+		r.values = map[string]string{}
+	}
+	r.values[name] = value
+}
+
+func (r *Results) Get(name string) (value string, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	value, ok = r.values[name]
+	return
+}
+
+// Values returns a copy of the values
+func (r *Results) Values() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ret := make(map[string]string, len(r.values))
+	for k, v := range r.values {
+		ret[k] = v
+	}
+	return ret
 }
 
 type Link interface {
@@ -121,20 +198,61 @@ type Link interface {
 	Run(*Status) error
 }
 
+// definer is implemented by Links that set constants when they are run
+type definer interface {
+	Defines() []string
+}
+
 type CmdChain struct {
 
 	//TODO remove this (this should come from outside)
 	Environment
 
 	Links []Link
+
+	// Params are the declared parameters of the chain with their default
+	// values. They are set as constants with SetParams.
+	Params map[string]string
+
+	// Lines are the script line numbers of the Links. This is empty if
+	// the chain is not created from a script.
+	Lines []int
+
+	// MaxParallel is the maximum number of Links that are run at the same
+	// time. If it is less than 2, the Links are run one after another.
+	MaxParallel int
 }
 
+// Validate validates the Links in order. The constants defined by a Link are
+// available for the Links after it.
 func (c *CmdChain) Validate(e *Environment) (err error) {
-	for _, l := range c.Links {
-		err = l.Validate(e)
+	env := *e
+	env.Constants = make(map[string]string, len(e.Constants))
+	for k, v := range e.Constants {
+		env.Constants[k] = v
+	}
+	for name, def := range c.Params {
+		if _, ok := env.Constants[name]; !ok {
+			env.Constants[name] = def
+		}
+	}
+
+	for i, l := range c.Links {
+		err = l.Validate(&env)
 		if err != nil {
+			if len(c.Lines) == len(c.Links) {
+				err = util.E.Annotate(err, "line ", c.Lines[i])
+			}
 			return
 		}
+
+		if d, ok := l.(definer); ok {
+			for _, name := range d.Defines() {
+				if _, ok := env.Constants[name]; !ok {
+					env.Constants[name] = ""
+				}
+			}
+		}
 	}
 	return
 }
@@ -145,6 +263,10 @@ func (c *CmdChain) Run(s *Status) (err error) {
 		return
 	}
 
+	if c.MaxParallel > 1 {
+		return c.runParallel(s)
+	}
+
 	for i := range c.Links {
 		err = c.Links[i].Run(s)
 		if err != nil {
@@ -155,6 +277,32 @@ func (c *CmdChain) Run(s *Status) (err error) {
 	return
 }
 
+// SetParams validates the values of the parameters and sets them as constants
+// to the Status. The parameters without a value get their defaults.
+func (c *CmdChain) SetParams(s *Status, values map[string]string) (err error) {
+	for name, v := range values {
+		if _, ok := c.Params[name]; !ok {
+			return util.E.New("parameter \"%s\" is not declared", name)
+		}
+		if !paramValueRe.MatchString(v) {
+			return util.E.New("invalid value \"%s\" for parameter \"%s\"", v, name)
+		}
+	}
+
+	for name, def := range c.Params {
+		if _, ok := s.Constants[name]; ok {
+			return util.E.New("parameter \"%s\" conflicts with a constant", name)
+		}
+
+		v, ok := values[name]
+		if !ok {
+			v = def
+		}
+		s.Constants[name] = v
+	}
+	return
+}
+
 func RunCmdChain(c *CmdChain, s *Status) (err error) {
 	err = s.Environment.initEnv()
 	if err != nil {
@@ -178,10 +326,14 @@ type Cmd struct {
 
 // NewCmd creates a new Cmd from given command string
 func NewCmd(cmdstr string) (c *Cmd, err error) {
-	command := splitWsQuote(cmdstr)
+	return newCmdArgs(splitWsQuote(cmdstr))
+}
 
+// newCmdArgs creates a new Cmd from an already split command
+func newCmdArgs(command []string) (c *Cmd, err error) {
 	if len(command) == 0 {
-		return nil, util.E.New("A command could not be parsed from: %s", cmdstr)
+		return nil, util.E.New("A command could not be parsed from: %s",
+			strings.Join(command, " "))
 	}
 
 	c = &Cmd{command}
@@ -197,6 +349,25 @@ func NewCmd(cmdstr string) (c *Cmd, err error) {
 
 // Validate makes sure the command is proper and can be run
 func (c *Cmd) Validate(e *Environment) (err error) {
+	err = c.validateArgs(e)
+	if err != nil {
+		return
+	}
+
+	_, err = exec.LookPath(c.Cmd[0])
+	if err != nil {
+		return
+	}
+
+	if e.Sandbox != nil {
+		err = e.Sandbox.validate()
+	}
+	return
+}
+
+// validateArgs makes sure the command is allowed and its constants and
+// redirections are proper
+func (c *Cmd) validateArgs(e *Environment) (err error) {
 	if len(c.Cmd) == 0 {
 		return util.E.New("command string must be non-empty")
 	}
@@ -207,21 +378,19 @@ func (c *Cmd) Validate(e *Environment) (err error) {
 		}
 	}
 
-	_, err = exec.LookPath(c.Cmd[0])
-	if err != nil {
-		return
+	if e.Policy != nil {
+		err = e.Policy.Check(c.Cmd)
+		if err != nil {
+			return
+		}
 	}
 
 	err = e.validate()
 
 	for idx, a := range c.Cmd {
-		consts := parseConsts(a)
-		if len(consts) > 0 {
-			for _, co := range consts {
-				if _, ok := e.Constants[co]; !ok {
-					return util.E.New("constant \"%s\" not defined", co)
-				}
-			}
+		e2 := validateConsts(a, e)
+		if e2 != nil {
+			return e2
 		}
 
 		// Output redirection to a file
@@ -239,79 +408,398 @@ func (c *Cmd) Run(s *Status) (err error) {
 		return
 	}
 
-	var args []string
+	return c.execute(s, s.Log)
+}
+
+// expandArgs expands the constants of the command, checks the expanded
+// arguments against the policy and opens the file its output is redirected
+// to. The redirection is removed from the returned arguments. The returned
+// file must be closed if it is non-nil.
+func (c *Cmd) expandArgs(s *Status, output io.Writer) (args []string, out io.Writer, fp *os.File, err error) {
 	for i := range c.Cmd {
-		args = append(args, expandConsts(c.Cmd[i], s.Constants))
+		var arg string
+		arg, err = expandConstsStrict(c.Cmd[i], s.Constants)
+		if err != nil {
+			return
+		}
+		args = append(args, arg)
 	}
 
 	if s.Log != nil {
 		fmt.Fprintln(s.Log, "# Running command:", strings.Join(args, " "))
 	}
 
-	var output io.Writer = s.Log
+	if s.Policy != nil {
+		err = s.Policy.CheckExpanded(args)
+		if err != nil {
+			return
+		}
+	}
 
+	out = output
 	redirout, pos := getRedirectFile(">", args)
 	if redirout != "" {
-		var fp *os.File
-		redirout = PathAbs(s.RootDir, redirout)
+		redirout, err = s.filePath(redirout, true)
+		if err != nil {
+			return
+		}
 		fp, err = os.OpenFile(redirout, os.O_WRONLY | os.O_CREATE, 0666)
 		if err != nil {
 			err = util.E.Annotate(err, "Could not open file",redirout,"for redirection")
 			return
 		}
-		defer fp.Close()
-		output = fp
+		out = fp
 
 		// Remove the redirection and the file argument from the command
 		args = append(args[:pos], args[pos+2:]...)
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Dir = s.RootDir
+	return
+}
+
+// execute runs the command and writes its standard output to output unless
+// it is redirected
+func (c *Cmd) execute(s *Status, output io.Writer) (err error) {
+	if s.Cache != nil {
+		return s.Cache.execute(c, s, output, c.run)
+	}
+	return c.run(s, output)
+}
+
+func (c *Cmd) run(s *Status, output io.Writer) (err error) {
+	args, output, fp, err := c.expandArgs(s, output)
+	if err != nil {
+		return
+	}
+	if fp != nil {
+		defer fp.Close()
+	}
+
+	var cmd *exec.Cmd
+	if s.Sandbox != nil {
+		cmd, err = s.Sandbox.command(s.runContext(), s.RootDir, c.readable(s), c.writable(s), args)
+		if err != nil {
+			return
+		}
+		if fp == nil {
+			output = s.Sandbox.limitOutput(output)
+		}
+	} else {
+		cmd = exec.CommandContext(s.runContext(), args[0], args[1:]...)
+		cmd.Dir = s.RootDir
+	}
 	cmd.Stdout = output
 	cmd.Stderr = s.Log
 
-	return cmd.Run()
+	err = cmd.Run()
+	if err != nil && s.runContext().Err() == context.DeadlineExceeded {
+		err = util.E.Annotate(err, "The command timed out")
+	}
+	return
+}
+
+////////////////////////////////////////////////////////////
+
+// executor is a Link whose standard output can be written to a given writer
+type executor interface {
+	Link
+	execute(*Status, io.Writer) error
+}
+
+// Capture is a Link that runs a command and stores its trimmed standard
+// output to the constant Name
+type Capture struct {
+	Name string
+	Cmd  executor
+}
+
+func (c *Capture) Defines() []string {
+	return []string{c.Name}
+}
+
+// Validate makes sure the command is proper and its output is not redirected
+func (c *Capture) Validate(e *Environment) (err error) {
+	if c.Name == "" || c.Cmd == nil {
+		return util.E.New("capture requires a constant name and a command")
+	}
+	if tmpfileConstRe.MatchString("$" + c.Name) {
+		return util.E.New("output cannot be captured to temporary file constant \"%s\"", c.Name)
+	}
+	var args []string
+	switch cmd := c.Cmd.(type) {
+	case *Cmd:
+		args = cmd.Cmd
+	case *Builtin:
+		args = cmd.Cmd.Cmd
+	}
+	for _, a := range args {
+		if a == ">" {
+			return util.E.New("the output of a captured command cannot be redirected")
+		}
+	}
+
+	return c.Cmd.Validate(e)
+}
+
+func (c *Capture) Run(s *Status) (err error) {
+	err = c.Validate(&s.Environment)
+	if err != nil {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = c.Cmd.execute(s, buf)
+	if err != nil {
+		return
+	}
+
+	s.Constants[c.Name] = strings.TrimSpace(buf.String())
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "# Captured constant %s: %s\n", c.Name, s.Constants[c.Name])
+	}
+	return
+}
+
+// Optional is a Link whose failure is only logged
+type Optional struct {
+	Link
+}
+
+func (o *Optional) Defines() []string {
+	return linkDefines(o.Link)
+}
+
+func (o *Optional) Run(s *Status) (err error) {
+	err = o.Link.Run(s)
+	if err != nil {
+		if s.Log != nil {
+			fmt.Fprintln(s.Log, "# Optional command failed:", err)
+		}
+		err = nil
+	}
+	return
+}
+
+// Fallback is a Link that runs its Links in order until one of them succeeds
+type Fallback struct {
+	Links []Link
+}
+
+func (f *Fallback) Defines() (ret []string) {
+	for _, l := range f.Links {
+		ret = append(ret, linkDefines(l)...)
+	}
+	return
+}
+
+func (f *Fallback) Validate(e *Environment) (err error) {
+	if len(f.Links) == 0 {
+		return util.E.New("fallback requires at least one command")
+	}
+	for _, l := range f.Links {
+		err = l.Validate(e)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *Fallback) Run(s *Status) (err error) {
+	for i, l := range f.Links {
+		err = l.Run(s)
+		if err == nil {
+			return
+		}
+		if s.Log != nil && i < len(f.Links)-1 {
+			fmt.Fprintln(s.Log, "# Command failed, running the fallback:", err)
+		}
+	}
+	return
+}
+
+// Guard is a Link that runs its Link only if the file in Path exists and is
+// not empty. Temporary files are created empty, so they are considered to
+// exist only after a command has written to them.
+type Guard struct {
+	Path string
+	Link
+}
+
+func (g *Guard) Defines() []string {
+	return linkDefines(g.Link)
+}
+
+func (g *Guard) Validate(e *Environment) (err error) {
+	err = validateConsts(g.Path, e)
+	if err != nil {
+		return
+	}
+	return g.Link.Validate(e)
+}
+
+func (g *Guard) Run(s *Status) (err error) {
+	err = g.Validate(&s.Environment)
+	if err != nil {
+		return
+	}
+
+	path, err := expandConstsStrict(g.Path, s.Constants)
+	if err != nil {
+		return
+	}
+	path = PathAbs(s.RootDir, path)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		if s.Log != nil {
+			fmt.Fprintln(s.Log, "# Skipping command as file does not exist:", path)
+		}
+		return nil
+	}
+
+	return g.Link.Run(s)
+}
+
+// Timeout is a Link whose commands are killed if it runs longer than the
+// Duration. The built-in commands implemented in Go are not interrupted,
+// but the programs they run are.
+type Timeout struct {
+	Duration time.Duration
+	Link
+}
+
+func (t *Timeout) Defines() []string {
+	return linkDefines(t.Link)
+}
+
+func (t *Timeout) Validate(e *Environment) (err error) {
+	if t.Duration <= 0 {
+		return util.E.New("timeout must be positive")
+	}
+	return t.Link.Validate(e)
+}
+
+func (t *Timeout) Run(s *Status) (err error) {
+	ctx, cancel := context.WithTimeout(s.runContext(), t.Duration)
+	defer cancel()
+
+	// The copy shares the constants and the results with s
+	ts := *s
+	ts.ctx = ctx
+	err = t.Link.Run(&ts)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && s.Log != nil {
+		fmt.Fprintln(s.Log, "# Command exceeded its timeout of", t.Duration)
+	}
+	return
+}
+
+// linkDefines returns the constants the given Link defines
+func linkDefines(l Link) []string {
+	if d, ok := l.(definer); ok {
+		return d.Defines()
+	}
+	return nil
 }
 
 ////////////////////////////////////////////////////////////
 
 var (
-	constRe         = regexp.MustCompile(`\$(\w+)`)
+	constRe         = regexp.MustCompile(`\$(?:\$|\{(\w+)(:-[^}]*)?\}|(\w+))`)
 	tmpfileConstRe  = regexp.MustCompile(`\$(tmp\w+)`)
+	constNameRe     = regexp.MustCompile(`^\$(\w+)$`)
+	wordRe          = regexp.MustCompile(`^\w+$`)
+	paramRe         = regexp.MustCompile(`^\s*#\s*param\s+(\w+)=(\S*)\s*$`)
+	paramValueRe    = regexp.MustCompile(`^[\w.,:+-]*$`)
 	commentRe       = regexp.MustCompile(`#.*$`)
 	preWhitespaceRe = regexp.MustCompile(`^\s+`)
 )
 
+// constRef is a reference to a constant in a string
+type constRef struct {
+	Name string
+
+	// Default is used if the constant is undefined or empty
+	Default    string
+	HasDefault bool
+}
+
+// parseConstRefs parses the constant references from a string. The
+// references are of the forms $name, ${name} and ${name:-default}. The $$ is
+// an escaped dollar sign.
+func parseConstRefs(s string) (ret []constRef) {
+	for _, m := range constRe.FindAllStringSubmatch(s, -1) {
+		switch {
+		case m[1] != "":
+			ret = append(ret, constRef{m[1], strings.TrimPrefix(m[2], ":-"), m[2] != ""})
+		case m[3] != "":
+			ret = append(ret, constRef{Name: m[3]})
+		}
+	}
+	return
+}
+
 // parseConsts parses the constants from a string. Returns a list of constant names
 func parseConsts(s string) (ret []string) {
 	ret = []string{}
 
-	matches := constRe.FindAllStringSubmatch(s, -1)
-	if matches == nil {
-		return
-	}
-	for _, m := range matches {
-		ret = append(ret, m[1])
+	for _, r := range parseConstRefs(s) {
+		ret = append(ret, r.Name)
 	}
 
 	return
 }
 
+// validateConsts makes sure the constants without a default are defined and
+// the braces of the references are closed
+func validateConsts(s string, e *Environment) error {
+	for _, r := range parseConstRefs(s) {
+		if _, ok := e.Constants[r.Name]; !ok && !r.HasDefault {
+			return util.E.New("constant \"%s\" not defined", r.Name)
+		}
+	}
+
+	if strings.Contains(constRe.ReplaceAllString(s, ""), "${") {
+		return util.E.New("invalid constant reference in \"%s\"", s)
+	}
+	return nil
+}
+
+// expandConsts expands the constants in s. Undefined constants without a
+// default are replaced with an empty string.
 func expandConsts(s string, constants map[string]string) string {
-	return constRe.ReplaceAllStringFunc(s, func(match string) string {
-		cs := parseConsts(match)
-		if len(cs) != 1 {
+	ret, _ := expandConstsMode(s, constants, false)
+	return ret
+}
+
+// expandConstsStrict expands the constants in s. It is an error if a
+// constant without a default is undefined.
+func expandConstsStrict(s string, constants map[string]string) (string, error) {
+	return expandConstsMode(s, constants, true)
+}
+
+func expandConstsMode(s string, constants map[string]string, strict bool) (ret string, err error) {
+	ret = constRe.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		refs := parseConstRefs(match)
+		if len(refs) != 1 {
 			panic("Invalid Regexp parsing")
 		}
+		r := refs[0]
 
-		ret, ok := constants[cs[0]]
-		if !ok {
-			ret = ""
+		ret, ok := constants[r.Name]
+		switch {
+		case r.HasDefault && ret == "":
+			ret = r.Default
+		case !ok && strict && err == nil:
+			err = util.E.New("constant \"%s\" not defined", r.Name)
 		}
 
 		return ret
 	})
+	return
 }
 
 // Gets the string after the given redir string. If not found, returns empty
@@ -335,14 +823,42 @@ func getRedirectFile(redir string, args []string) (file string, pos int) {
 //
 // - Comments start with # and end with EOL.
 //
-// - Constants are strings that begin with $ and they can be set before running the cmdchain.
+// - Constants are strings that begin with $ and they can be set before running the cmdchain. The name can be written in braces as ${name} and a default for an undefined or empty constant can be given with ${name:-default}. A literal dollar sign is written as $$. Using an undefined constant without a default is an error.
 //
 // - Temporary files are strings that start with $tmp and they are automatically created before running the cmdchain and removed afterwards.
+//
+// - A line of the form "$name = command" captures the trimmed standard output of the command to the constant name. The lines after it can use the constant.
+//
+// - Parameters are declared with comment lines of the form "# param name=default". They are constants whose values are given with SetParams.
+//
+// - Commands starting with @ are built-in commands implemented in Go. They are registered with RegisterBuiltin.
+//
+// - Commands separated with || are fallbacks: the next one is run only if the previous one fails.
+//
+// - A line starting with - is optional: its failure is logged and the chain continues.
+//
+// - A line of the form "if exists FILE command" runs the command only if FILE exists and is not empty.
+//
+// - A line of the form "timeout DURATION command" kills the command if it runs longer than the DURATION, such as 30s or 2m.
 func NewCmdChainScript(script string) (c *CmdChain, err error) {
 	c = &CmdChain{}
 	c.Constants = make(map[string]string)
+	defined := map[string]bool{}
+
+	for i, line := range strings.Split(script, "\n") {
+		if m := paramRe.FindStringSubmatch(line); m != nil {
+			if !paramValueRe.MatchString(m[2]) {
+				return nil, util.E.New("line %d: invalid default for parameter %s", i+1, m[1])
+			}
+			if c.Params == nil {
+				c.Params = map[string]string{}
+			}
+			c.Params[m[1]] = m[2]
+			defined[m[1]] = true
+			delete(c.Constants, m[1])
+			continue
+		}
 
-	for _, line := range strings.Split(script, "\n") {
 		line = commentRe.ReplaceAllString(line, "")
 		line = preWhitespaceRe.ReplaceAllString(line, "")
 
@@ -350,21 +866,31 @@ func NewCmdChainScript(script string) (c *CmdChain, err error) {
 			continue
 		}
 
+		var link Link
+		link, err = parseLink(splitWsQuote(line))
+		if err != nil {
+			return nil, util.E.Annotate(err, "improper command")
+		}
+		for _, co := range linkDefines(link) {
+			defined[co] = true
+		}
+
 		constants := parseConsts(line)
 		for _, co := range constants {
+			if defined[co] {
+				continue
+			}
+			if _, ok := c.Constants[co]; ok {
+				continue
+			}
 			c.Constants[co] = ""
 			if tmpfileConstRe.MatchString("$" + co) {
 				c.TempFiles = append(c.TempFiles, co)
 			}
 		}
 
-		var cmd *Cmd
-		cmd, err = NewCmd(line)
-		if err != nil {
-			return nil, util.E.Annotate(err, "improper command")
-		}
-
-		c.Links = append(c.Links, cmd)
+		c.Links = append(c.Links, link)
+		c.Lines = append(c.Lines, i+1)
 	}
 
 	e := c.Environment
@@ -378,24 +904,130 @@ func NewCmdChainScript(script string) (c *CmdChain, err error) {
 	return
 }
 
+// parseLink creates a Link from a split script line
+func parseLink(args []string) (l Link, err error) {
+	if len(args) == 0 {
+		return nil, util.E.New("A command could not be parsed from an empty line")
+	}
+
+	switch {
+	case strings.HasPrefix(args[0], "-"):
+		rest := args[1:]
+		if args[0] != "-" {
+			rest = append([]string{args[0][1:]}, rest...)
+		}
+		l, err = parseLink(rest)
+		if err != nil {
+			return
+		}
+		return &Optional{l}, nil
+	case args[0] == "if":
+		if len(args) < 4 || args[1] != "exists" {
+			return nil, util.E.New("The condition syntax is: if exists FILE COMMAND")
+		}
+		l, err = parseLink(args[3:])
+		if err != nil {
+			return
+		}
+		return &Guard{Path: args[2], Link: l}, nil
+	case args[0] == "timeout":
+		var d time.Duration
+		if len(args) >= 3 {
+			d, err = time.ParseDuration(args[1])
+		}
+		if len(args) < 3 || err != nil || d <= 0 {
+			return nil, util.E.New("The timeout syntax is: timeout DURATION COMMAND")
+		}
+		l, err = parseLink(args[2:])
+		if err != nil {
+			return
+		}
+		return &Timeout{Duration: d, Link: l}, nil
+	}
+
+	capture := ""
+	if len(args) > 1 && args[1] == "=" && constNameRe.MatchString(args[0]) {
+		capture = args[0][1:]
+		args = args[2:]
+	}
+
+	var links []Link
+	start := 0
+	for i := 0; i <= len(args); i++ {
+		if i < len(args) && args[i] != "||" {
+			continue
+		}
+
+		if i == start {
+			return nil, util.E.New("A command could not be parsed around ||")
+		}
+
+		// The existence of the commands is checked when validating
+		var cmd executor
+		if isBuiltin(args[start]) {
+			cmd = &Builtin{Cmd{args[start:i]}}
+		} else {
+			cmd = &Cmd{args[start:i]}
+		}
+		start = i + 1
+
+		if capture != "" {
+			links = append(links, &Capture{Name: capture, Cmd: cmd})
+		} else {
+			links = append(links, cmd)
+		}
+	}
+
+	if len(links) == 1 {
+		return links[0], nil
+	}
+	return &Fallback{links}, nil
+}
+
 // splitWsQuote splits a string by whitespace, but takes doublequotes into
 // account
 func splitWsQuote(s string) []string {
+	ret, _, _ := splitWsQuotePos(s)
+	return ret
+}
 
+// splitWsQuotePos splits the string like splitWsQuote. Returns also the byte
+// offsets of the fields in s and the offset of an unclosed quote or -1.
+func splitWsQuotePos(s string) (fields []string, offsets []int, unclosed int) {
+	fields = []string{}
+	offsets = []int{}
 	quote := rune(0)
+	unclosed = -1
+	start := -1
 
-	return strings.FieldsFunc(s, func(r rune) bool {
+	for i, r := range s {
+		sep := false
 		switch {
 		case r == quote:
 			quote = rune(0)
-			return true
+			unclosed = -1
+			sep = true
 		case quote != rune(0):
-			return false
 		case unicode.In(r, unicode.Quotation_Mark):
 			quote = r
-			return true
+			unclosed = i
+			sep = true
 		default:
-			return unicode.IsSpace(r)
+			sep = unicode.IsSpace(r)
 		}
-	})
+
+		switch {
+		case sep && start >= 0:
+			fields = append(fields, s[start:i])
+			offsets = append(offsets, start)
+			start = -1
+		case !sep && start < 0:
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+		offsets = append(offsets, start)
+	}
+	return
 }
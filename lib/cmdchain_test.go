@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_parseConsts(t *testing.T) {
@@ -20,6 +22,10 @@ func Test_parseConsts(t *testing.T) {
 		{"Single variable", args{"$a"}, []string{"a"}},
 		{"Many variables", args{"$a $b $c"}, []string{"a", "b", "c"}},
 		{"Combined", args{"$first$second"}, []string{"first", "second"}},
+		{"Braced", args{"${a}.pnm"}, []string{"a"}},
+		{"Default", args{"${a:-value} $b"}, []string{"a", "b"}},
+		{"Escaped", args{"$$a $$"}, []string{}},
+		{"Unterminated brace", args{"${a"}, []string{}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -56,6 +62,19 @@ func Test_expandConsts(t *testing.T) {
 			"a": "some",
 			"b": "thing",
 		}}, "something"},
+		{"Braced", args{"${a}thing", map[string]string{
+			"a": "some",
+		}}, "something"},
+		{"Default for undefined", args{"${a:-some}thing", map[string]string{}}, "something"},
+		{"Default for empty", args{"${a:-some}thing", map[string]string{
+			"a": "",
+		}}, "something"},
+		{"Default not used", args{"${a:-other}thing", map[string]string{
+			"a": "some",
+		}}, "something"},
+		{"Escaped", args{"$$a costs $$5", map[string]string{
+			"a": "some",
+		}}, "$a costs $5"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -66,6 +85,33 @@ func Test_expandConsts(t *testing.T) {
 	}
 }
 
+func Test_expandConstsStrict(t *testing.T) {
+	constants := map[string]string{"a": "some"}
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"Defined", "${a}thing", "something", false},
+		{"Undefined", "$a$undefined", "", true},
+		{"Undefined with a default", "$a${undefined:-thing}", "something", false},
+		{"Escaped", "$$undefined", "$undefined", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandConstsStrict(tt.s, constants)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expandConstsStrict() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("expandConstsStrict() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestNewCmdChainScript(t *testing.T) {
 	type args struct {
 		script string
@@ -88,6 +134,7 @@ func TestNewCmdChainScript(t *testing.T) {
 		{"Single command", args{"true"}, &CmdChain{
 			Links:       []Link{&Cmd{[]string{"true"}}},
 			Environment: Environment{Constants: map[string]string{}},
+			Lines:       []int{1},
 		}, false},
 
 		{"Two commands", args{"true\nfalse"}, &CmdChain{
@@ -96,6 +143,7 @@ func TestNewCmdChainScript(t *testing.T) {
 				&Cmd{[]string{"false"}},
 			},
 			Environment: Environment{Constants: map[string]string{}},
+			Lines:       []int{1, 2},
 		}, false},
 
 		{"Arguments", args{"true first second"}, &CmdChain{
@@ -103,6 +151,7 @@ func TestNewCmdChainScript(t *testing.T) {
 				&Cmd{[]string{"true", "first", "second"}},
 			},
 			Environment: Environment{Constants: map[string]string{}},
+			Lines:       []int{1},
 		}, false},
 
 		{"Quoted arguments", args{"true 'first second'"}, &CmdChain{
@@ -110,6 +159,7 @@ func TestNewCmdChainScript(t *testing.T) {
 				&Cmd{[]string{"true", "first second"}},
 			},
 			Environment: Environment{Constants: map[string]string{}},
+			Lines:       []int{1},
 		}, false},
 
 		{"Included a constant", args{"true $variable"}, &CmdChain{
@@ -121,6 +171,7 @@ func TestNewCmdChainScript(t *testing.T) {
 			Links: []Link{
 				&Cmd{[]string{"true", "$variable"}},
 			},
+			Lines: []int{1},
 		}, false},
 
 		{"Command not found", args{"this-command-is-not-found"}, nil, true},
@@ -135,7 +186,64 @@ func TestNewCmdChainScript(t *testing.T) {
 			Links: []Link{
 				&Cmd{[]string{"true", "$tmpSomething"}},
 			},
+			Lines: []int{1},
+		}, false},
+
+		{"Captured constant", args{"$v = echo a\ntrue $v"}, &CmdChain{
+			Environment: Environment{Constants: map[string]string{}},
+			Links: []Link{
+				&Capture{Name: "v", Cmd: &Cmd{[]string{"echo", "a"}}},
+				&Cmd{[]string{"true", "$v"}},
+			},
+			Lines: []int{1, 2},
+		}, false},
+
+		{"Capture to a temporary file", args{"$tmpv = echo a"}, nil, true},
+
+		{"Fallback commands", args{"false || true"}, &CmdChain{
+			Environment: Environment{Constants: map[string]string{}},
+			Links: []Link{
+				&Fallback{[]Link{
+					&Cmd{[]string{"false"}},
+					&Cmd{[]string{"true"}},
+				}},
+			},
+			Lines: []int{1},
 		}, false},
+
+		{"Optional command", args{"-false\n- true"}, &CmdChain{
+			Environment: Environment{Constants: map[string]string{}},
+			Links: []Link{
+				&Optional{&Cmd{[]string{"false"}}},
+				&Optional{&Cmd{[]string{"true"}}},
+			},
+			Lines: []int{1, 2},
+		}, false},
+
+		{"Conditional command", args{"if exists $tmpA cat $tmpA"}, &CmdChain{
+			Environment: Environment{
+				Constants: map[string]string{"tmpA": ""},
+				TempFiles: []string{"tmpA"},
+			},
+			Links: []Link{
+				&Guard{"$tmpA", &Cmd{[]string{"cat", "$tmpA"}}},
+			},
+			Lines: []int{1},
+		}, false},
+
+		{"Timeout", args{"timeout 1m30s - sleep 1"}, &CmdChain{
+			Environment: Environment{Constants: map[string]string{}},
+			Links: []Link{
+				&Timeout{90 * time.Second, &Optional{&Cmd{[]string{"sleep", "1"}}}},
+			},
+			Lines: []int{1},
+		}, false},
+
+		{"Improper condition", args{"if $tmpA cat $tmpA"}, nil, true},
+		{"Timeout without a unit", args{"timeout 10 sleep 1"}, nil, true},
+		{"Negative timeout", args{"timeout -1s sleep 1"}, nil, true},
+		{"Timeout without a command", args{"timeout 1s"}, nil, true},
+		{"Empty fallback", args{"true ||"}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -217,6 +325,15 @@ func TestCmd_Validate(t *testing.T) {
 
 		{"Constant is not defined", fields{[]string{"true", "$else"}}, args{}, true},
 
+		{"Braced constant is not defined", fields{[]string{"true", "${else}.pnm"}}, args{}, true},
+
+		{"Undefined constant with a default", fields{[]string{"true", "${else:-value}"}},
+			args{}, false},
+
+		{"Escaped dollar sign", fields{[]string{"true", "$$else"}}, args{}, false},
+
+		{"Unterminated brace", fields{[]string{"true", "${else"}}, args{}, true},
+
 		{"Commands cannot be read from a constant", fields{[]string{"$cmd"}},
 			args{Environment{
 				Constants: map[string]string{
@@ -386,6 +503,27 @@ func TestRunCmdChain(t *testing.T) {
 		{"Existing temporary file", "echo $tmpmsg\ncat $tmpmsg", nil,
 			true, false, "", false},
 		{"Failing commands", "true\nfalse\ntrue", nil, true, false, "", true},
+		{"Captured constant", "$msg = echo ' piip '\necho $msg", nil, true, true,
+			"# Running command: echo  piip \n# Captured constant msg: piip\n" +
+				"# Running command: echo piip\npiip\n", false},
+		{"Fallback", "false || echo piip", nil, true, true,
+			"# Running command: false\n# Command failed, running the fallback: exit status 1\n" +
+				"# Running command: echo piip\npiip\n", false},
+		{"Failing fallbacks", "false || false", nil, true, false, "", true},
+		{"Captured fallback", "$msg = false || echo piip\necho $msg", nil, true, false, "", false},
+		{"Optional command", "-false\necho piip", nil, true, true,
+			"# Running command: false\n# Optional command failed: exit status 1\n" +
+				"# Running command: echo piip\npiip\n", false},
+		{"Condition on an empty file", "if exists $tmpa echo piip", nil, true, false, "", false},
+		{"Condition on a written file", "echo piip > $tmpa\nif exists $tmpa cat $tmpa", nil,
+			true, false, "", false},
+		{"Within the timeout", "timeout 10s echo piip", nil, true, true,
+			"# Running command: echo piip\npiip\n", false},
+		{"Exceeded timeout", "timeout 100ms sleep 10\necho piip", nil, true, true,
+			"# Running command: sleep 10\n# Command exceeded its timeout of 100ms\n", true},
+		{"Optional timeout", "- timeout 100ms sleep 10", nil, true, true,
+			"# Running command: sleep 10\n# Command exceeded its timeout of 100ms\n" +
+				"# Optional command failed: The command timed out: signal: killed\n", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -416,3 +554,162 @@ func TestRunCmdChain(t *testing.T) {
 		})
 	}
 }
+
+func TestCmdChain_dependencies(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   [][]int
+	}{
+		{"Independent commands", "true\ntrue", [][]int{nil, nil}},
+		{"Written and read", "echo a > $tmpA\ncat $tmpA", [][]int{nil, {0}}},
+		{"Read by two", "echo a > $tmpA\ncp $tmpA $tmpB\ncp $tmpA $tmpC",
+			[][]int{nil, {0}, {0}}},
+		{"Written twice", "echo a > $tmpA\necho b > $tmpA", [][]int{nil, {0}}},
+		{"Captured constant", "$a = echo a\necho $a\ntrue", [][]int{nil, {0}, nil}},
+		{"Read before written", "cp $tmpA $tmpB\necho a > $tmpA", [][]int{nil, {0}}},
+		{"Literal file", "@copy $tmpA out.png\n@checksum out.png\ntrue",
+			[][]int{nil, {0}, {0, 1}}},
+		{"Literal file in a redirection", "echo a > $tmpA\necho b > /tmp/b\ncat $tmpA",
+			[][]int{nil, {0}, {0, 1}}},
+		{"Not files", "sleep 0.1\necho -n 80% 90 200x200 pnm:$tmpA > $tmpB\ntrue",
+			[][]int{nil, nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewCmdChainScript(tt.script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			compare(t, "CmdChain.dependencies() not expected", tt.want, ch.dependencies())
+		})
+	}
+}
+
+func TestCmdChain_runParallel(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		output  string
+		wantErr bool
+	}{
+		{"Log is in order", "sleep 0.1\necho a\necho b",
+			"# Running command: sleep 0.1\n# Running command: echo a\na\n" +
+				"# Running command: echo b\nb\n", false},
+		{"Dependent commands", "echo piip > $tmpA\n$a = cat $tmpA\necho $a",
+			"# Running command: echo piip\npiip\n", false},
+		{"Failing command", "true\nfalse\ntrue", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewCmdChainScript(tt.script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			ch.MaxParallel = 4
+
+			buf := &bytes.Buffer{}
+			s := Status{Environment: ch.Environment, Log: buf}
+			err = RunCmdChain(ch, &s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RunCmdChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !strings.HasSuffix(buf.String(), tt.output) {
+				t.Errorf("RunCmdChain() = [%v], want suffix [%v]", buf.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestCmdChain_SetParams(t *testing.T) {
+	script := "# param lang=fin\n# param size=a4\necho $lang $size"
+	tests := []struct {
+		name      string
+		values    map[string]string
+		constants map[string]string
+		want      map[string]string
+		wantErr   bool
+	}{
+		{"Defaults", nil, nil, map[string]string{"lang": "fin", "size": "a4"}, false},
+		{"Given value", map[string]string{"lang": "eng"}, nil,
+			map[string]string{"lang": "eng", "size": "a4"}, false},
+		{"Undeclared", map[string]string{"other": "x"}, nil, nil, true},
+		{"Invalid value", map[string]string{"lang": "a b"}, nil, nil, true},
+		{"Conflicting constant", nil, map[string]string{"lang": "x"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewCmdChainScript(script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			s := Status{Environment: ch.Environment}
+			s.Constants = map[string]string{}
+			for k, v := range tt.constants {
+				s.Constants[k] = v
+			}
+			err = ch.SetParams(&s, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CmdChain.SetParams() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(s.Constants, tt.want) {
+				t.Errorf("CmdChain.SetParams() constants = %v, want %v", s.Constants, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"Empty", "", map[string]string{}, false},
+		{"Two", "lang=eng, size=a5", map[string]string{"lang": "eng", "size": "a5"}, false},
+		{"Empty value", "lang=", map[string]string{"lang": ""}, false},
+		{"No value", "lang", nil, true},
+		{"No name", "=eng", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseParams(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseParams() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_literalPath(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{"out.png", true},
+		{"/tmp/file", true},
+		{"pnm:out.pnm", true},
+		{"dir/", true},
+		{"$tmpA.png", false},
+		{"pnm:$tmpA", false},
+		{"0.1", false},
+		{"80%", false},
+		{"200x200", false},
+		{"-rotate", false},
+		{"--out=a.png", false},
+		{"engine=tesseract", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			if got := literalPath(tt.arg); got != tt.want {
+				t.Errorf("literalPath(%q) = %v, want %v", tt.arg, got, tt.want)
+			}
+		})
+	}
+}
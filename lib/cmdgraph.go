@@ -0,0 +1,255 @@
+package paperless
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// accessor is implemented by Links that know the constants they read and
+// write. Links that do not implement it are run after all the earlier Links
+// and before all the later ones.
+type accessor interface {
+	Access() (reads, writes []string)
+}
+
+// anyConstant in the reads or writes of a Link makes it run after all the
+// earlier Links and before all the later ones like the Links that are not
+// accessors
+const anyConstant = "*"
+
+// A file name with an extension, e.g. out.png
+var fileExtRe = regexp.MustCompile(`[^.]\.[A-Za-z][A-Za-z0-9]{0,4}$`)
+
+// literalPath tells if the argument without constants looks like a file.
+// The files that are not in constants can not be tracked, so the argument
+// makes the command access anything.
+func literalPath(arg string) bool {
+	if len(parseConsts(arg)) > 0 || strings.HasPrefix(arg, "-") {
+		return false
+	}
+	// An ImageMagick format prefix, e.g. pnm:out.pnm
+	if i := strings.Index(arg, ":"); i > 0 {
+		arg = arg[i+1:]
+	}
+	return strings.Contains(arg, "/") || fileExtRe.MatchString(arg)
+}
+
+// Access returns the constants the command refers to. The target of the
+// output redirection is written. Without a redirection the last argument
+// referring to a constant is considered to be the output of the command.
+// A literal file argument accesses anything.
+func (c *Cmd) Access() (reads, writes []string) {
+	out := c.outputArg()
+	for i, a := range c.Cmd {
+		if i > 0 && literalPath(a) {
+			writes = append(writes, anyConstant)
+		}
+		if i == out {
+			writes = append(writes, parseConsts(a)...)
+		} else {
+			reads = append(reads, parseConsts(a)...)
+		}
+	}
+	return
+}
+
+// outputArg returns the index of the argument that is the output file of the
+// command or -1
+func (c *Cmd) outputArg() int {
+	if _, pos := getRedirectFile(">", c.Cmd); pos > 0 {
+		return pos + 1
+	}
+	for i := len(c.Cmd) - 1; i > 0; i-- {
+		if len(parseConsts(c.Cmd[i])) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Access of a built-in command considers all the constants to be written
+func (b *Builtin) Access() (reads, writes []string) {
+	for i, a := range b.Cmd.Cmd {
+		if i > 0 && literalPath(a) {
+			writes = append(writes, anyConstant)
+		}
+		writes = append(writes, parseConsts(a)...)
+	}
+	return
+}
+
+func (c *Capture) Access() (reads, writes []string) {
+	r, w := linkAccess(c.Cmd)
+	return append(r, w...), []string{c.Name}
+}
+
+func (o *Optional) Access() (reads, writes []string) {
+	return linkAccess(o.Link)
+}
+
+func (f *Fallback) Access() (reads, writes []string) {
+	for _, l := range f.Links {
+		r, w := linkAccess(l)
+		reads = append(reads, r...)
+		writes = append(writes, w...)
+	}
+	return
+}
+
+func (g *Guard) Access() (reads, writes []string) {
+	reads, writes = linkAccess(g.Link)
+	if literalPath(g.Path) {
+		writes = append(writes, anyConstant)
+	}
+	return append(reads, parseConsts(g.Path)...), writes
+}
+
+func (t *Timeout) Access() (reads, writes []string) {
+	return linkAccess(t.Link)
+}
+
+// linkAccess returns the constants the Link reads and writes if it is an
+// accessor
+func linkAccess(l Link) (reads, writes []string) {
+	if a, ok := l.(accessor); ok {
+		return a.Access()
+	}
+	return nil, nil
+}
+
+// dependencies returns the indices of the earlier Links each Link has to wait
+// for before it can be run
+func (c *CmdChain) dependencies() (ret [][]int) {
+	type access struct {
+		reads   map[string]bool
+		writes  map[string]bool
+		barrier bool
+	}
+
+	toSet := func(names []string) map[string]bool {
+		ret := map[string]bool{}
+		for _, n := range names {
+			ret[n] = true
+		}
+		return ret
+	}
+	intersects := func(a, b map[string]bool) bool {
+		for n := range a {
+			if b[n] {
+				return true
+			}
+		}
+		return false
+	}
+
+	acc := make([]access, len(c.Links))
+	for i, l := range c.Links {
+		a, ok := l.(accessor)
+		if !ok {
+			acc[i].barrier = true
+			continue
+		}
+		r, w := a.Access()
+		acc[i].reads = toSet(r)
+		acc[i].writes = toSet(w)
+		acc[i].barrier = acc[i].reads[anyConstant] || acc[i].writes[anyConstant]
+	}
+
+	ret = make([][]int, len(c.Links))
+	for i := range acc {
+		for j := 0; j < i; j++ {
+			if acc[i].barrier || acc[j].barrier ||
+				intersects(acc[i].writes, acc[j].reads) ||
+				intersects(acc[i].writes, acc[j].writes) ||
+				intersects(acc[i].reads, acc[j].writes) {
+				ret[i] = append(ret[i], j)
+			}
+		}
+	}
+	return
+}
+
+// runParallel runs the Links whose dependencies have completed at the same
+// time. The log of each Link is written after the logs of the earlier Links.
+func (c *CmdChain) runParallel(s *Status) (err error) {
+	type result struct {
+		idx    int
+		err    error
+		status *Status
+	}
+
+	deps := c.dependencies()
+	count := len(c.Links)
+	started := make([]bool, count)
+	done := make([]bool, count)
+	logs := make([]*bytes.Buffer, count)
+	results := make(chan result)
+	running := 0
+	flushed := 0
+
+	ready := func(i int) bool {
+		for _, d := range deps[i] {
+			if !done[d] {
+				return false
+			}
+		}
+		return true
+	}
+
+	flush := func() {
+		for ; flushed < count && done[flushed]; flushed++ {
+			if s.Log != nil {
+				s.Log.Write(logs[flushed].Bytes())
+			}
+		}
+	}
+
+	for {
+		for i := 0; err == nil && i < count && running < c.MaxParallel; i++ {
+			if started[i] || !ready(i) {
+				continue
+			}
+
+			ls := *s
+			logs[i] = &bytes.Buffer{}
+			ls.Log = logs[i]
+			ls.Constants = make(map[string]string, len(s.Constants))
+			for k, v := range s.Constants {
+				ls.Constants[k] = v
+			}
+
+			started[i] = true
+			running++
+			go func(i int, ls *Status) {
+				results <- result{i, c.Links[i].Run(ls), ls}
+			}(i, &ls)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		done[res.idx] = true
+		for _, name := range linkDefines(c.Links[res.idx]) {
+			if v, ok := res.status.Constants[name]; ok {
+				s.Constants[name] = v
+			}
+		}
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+		flush()
+	}
+
+	// Write the logs of the Links that were run after a failure
+	for i := flushed; i < count; i++ {
+		if done[i] && s.Log != nil {
+			s.Log.Write(logs[i].Bytes())
+		}
+	}
+
+	return
+}
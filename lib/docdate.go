@@ -0,0 +1,126 @@
+package paperless
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sources of the document date of an image
+const (
+	DateSourceExplicit = "explicit"
+	DateSourceText     = "text"
+	DateSourceExif     = "exif"
+)
+
+var finnishMonths = []string{
+	"tammikuuta", "helmikuuta", "maaliskuuta", "huhtikuuta",
+	"toukokuuta", "kesäkuuta", "heinäkuuta", "elokuuta",
+	"syyskuuta", "lokakuuta", "marraskuuta", "joulukuuta",
+}
+
+var (
+	// 17.10.2026 and 17.10.26
+	numericDateRe = regexp.MustCompile(`\b(\d{1,2})\.(\d{1,2})\.(\d{4}|\d{2})\b`)
+
+	// 2026-10-17
+	isoDateRe = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+
+	// 17. lokakuuta 2026
+	finnishDateRe = regexp.MustCompile(`(?i)\b(\d{1,2})\.\s*(` +
+		strings.Join(finnishMonths, "|") + `)\s+(\d{4})\b`)
+
+	// Words that precede the date of the document
+	dateKeywordRe = regexp.MustCompile(`(?i)(päivämäärä|päiväys|pvm|date|datum)\W*$`)
+
+	// Words that precede other dates, e.g. the due date of an invoice
+	otherDateKeywordRe = regexp.MustCompile(`(?i)(eräpäivä|erääntyy|due|förfallo\w*|syntymä\w*|voimassa)\W*$`)
+)
+
+// dateCandidate is a date found in the text
+type dateCandidate struct {
+	date  time.Time
+	pos   int
+	score int
+}
+
+// findDates returns the valid dates in the text in the order they appear
+func findDates(text string) (ret []dateCandidate) {
+	add := func(pos int, year, month, day string) {
+		y, _ := strconv.Atoi(year)
+		m, _ := strconv.Atoi(month)
+		d, _ := strconv.Atoi(day)
+		if len(year) == 2 {
+			y += 2000
+		}
+		t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.Local)
+		// time.Date normalizes the invalid dates, e.g. 31.2.
+		if t.Year() != y || int(t.Month()) != m || t.Day() != d {
+			return
+		}
+		ret = append(ret, dateCandidate{date: t, pos: pos})
+	}
+
+	for _, m := range numericDateRe.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[6]:m[7]], text[m[4]:m[5]], text[m[2]:m[3]])
+	}
+	for _, m := range isoDateRe.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[2]:m[3]], text[m[4]:m[5]], text[m[6]:m[7]])
+	}
+	for _, m := range finnishDateRe.FindAllStringSubmatchIndex(text, -1) {
+		name := strings.ToLower(text[m[4]:m[5]])
+		for i := range finnishMonths {
+			if finnishMonths[i] == name {
+				add(m[0], text[m[6]:m[7]], strconv.Itoa(i+1), text[m[2]:m[3]])
+			}
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].pos < ret[j].pos
+	})
+	return
+}
+
+// ExtractDocumentDate finds the date of the document from its text. Dates
+// far in the past or after now are ignored. Of the rest the date preceded by
+// a word like "päivämäärä" is preferred and a date preceded by a word like
+// "eräpäivä" is avoided. Then a date that appears many times and the first
+// one are preferred.
+func ExtractDocumentDate(text string, now time.Time) (ret time.Time, ok bool) {
+	candidates := findDates(text)
+
+	count := map[time.Time]int{}
+	for _, c := range candidates {
+		count[c.date]++
+	}
+
+	best := -1
+	for i := range candidates {
+		c := &candidates[i]
+		if c.date.Year() < 1970 || c.date.After(now) {
+			continue
+		}
+
+		// The text on the same line before the date
+		line := text[strings.LastIndex(text[:c.pos], "\n")+1 : c.pos]
+		switch {
+		case dateKeywordRe.MatchString(line):
+			c.score += 10
+		case otherDateKeywordRe.MatchString(line):
+			c.score -= 10
+		}
+		c.score += count[c.date] - 1
+
+		if best < 0 || c.score > candidates[best].score {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return
+	}
+	return candidates[best].date, true
+}
@@ -0,0 +1,41 @@
+package paperless
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtractDocumentDate(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	date := func(y, m, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name   string
+		text   string
+		want   time.Time
+		wantOk bool
+	}{
+		{"Finnish numeric", "Helsingissä 17.10.2026\n", date(2026, 10, 17), true},
+		{"Short year", "Kuitti 3.2.25 klo 12.00", date(2025, 2, 3), true},
+		{"ISO", "Printed 2026-10-17 by someone", date(2026, 10, 17), true},
+		{"Finnish month name", "Espoossa 17. lokakuuta 2026", date(2026, 10, 17), true},
+		{"Capitalized month name", "1. Tammikuuta 2020", date(2020, 1, 1), true},
+		{"Invalid date", "31.2.2026", time.Time{}, false},
+		{"Future date", "Voimassa 1.1.2030 asti", time.Time{}, false},
+		{"No date", "Ei päivämäärää", time.Time{}, false},
+		{"The first date", "1.9.2026\nTilattu 5.8.2026", date(2026, 9, 1), true},
+		{"Keyword", "Tilattu 5.8.2026\nPäivämäärä: 1.9.2026", date(2026, 9, 1), true},
+		{"Due date avoided", "Eräpäivä 1.9.2026\nLaskettu 5.8.2026", date(2026, 8, 5), true},
+		{"Repeated date", "5.8.2026\n1.9.2026\n2026-09-01", date(2026, 9, 1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ExtractDocumentDate(tt.text, now)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("ExtractDocumentDate() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package paperless
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// The largest number of differing bits of the perceptual hashes of
+	// near-identical images
+	duplicateDistance = 10
+
+	// The texts with at least these many words are compared
+	duplicateMinWords = 5
+
+	// The smallest text similarity of images with similar hashes and the
+	// smallest similarity that alone makes images duplicates
+	duplicateSimilarity     = 0.5
+	duplicateTextSimilarity = 0.9
+)
+
+// DHash calculates the difference hash of the image. The image is scaled
+// to 9x8 gray pixels and each bit tells if a pixel is brighter than its
+// right neighbour. Rescans of the same paper get hashes that differ only in
+// a few bits.
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	var gray [h][w]uint64
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*sh/h, b.Min.Y+(y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*sw/w, b.Min.X+(x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+
+			var sum, n uint64
+			for sy := y0; sy < y1 && sy < b.Max.Y; sy++ {
+				for sx := x0; sx < x1 && sx < b.Max.X; sx++ {
+					r, g, bl, _ := img.At(sx, sy).RGBA()
+					sum += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+					n++
+				}
+			}
+			if n > 0 {
+				gray[y][x] = sum / n
+			}
+		}
+	}
+
+	var ret uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			ret <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				ret |= 1
+			}
+		}
+	}
+	return ret
+}
+
+// setPHash sets the perceptual hash of the clean image or of the original
+// if the script did not produce a clean image
+func setPHash(img *Image, destdir string) {
+	img.PHash = ""
+	for _, file := range []string{img.CleanFile(destdir), img.OrigFile(destdir)} {
+		decoded, err := readImage(file)
+		if err == nil {
+			img.PHash = fmt.Sprintf("%016x", DHash(decoded))
+			return
+		}
+	}
+}
+
+// parseHash parses the hex hash. A hash without bits set is not valid as
+// all blank and single colored pages have it.
+func parseHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil && h != 0
+}
+
+// hashDistance returns the number of differing bits of the hex hashes. It
+// is not ok if either hash is not valid.
+func hashDistance(a, b string) (int, bool) {
+	ha, ok := parseHash(a)
+	if !ok {
+		return 0, false
+	}
+	hb, ok := parseHash(b)
+	if !ok {
+		return 0, false
+	}
+	return bits.OnesCount64(ha ^ hb), true
+}
+
+// textTerms returns the lowercase words of at least three letters or
+// digits in order. The shorter ones are mostly OCR noise.
+func textTerms(text string) (ret []string) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if len([]rune(w)) >= 3 {
+			ret = append(ret, w)
+		}
+	}
+	return
+}
+
+// textWords returns the distinct words of the text
+func textWords(text string) map[string]bool {
+	ret := map[string]bool{}
+	for _, w := range textTerms(text) {
+		ret[w] = true
+	}
+	return ret
+}
+
+// TextSimilarity returns the Jaccard similarity of the words of the texts
+// from 0 to 1. It is -1 if either text has too few words to compare.
+func TextSimilarity(a, b string) float64 {
+	return wordSimilarity(textWords(a), textWords(b))
+}
+
+// wordSimilarity returns the Jaccard similarity of the sets of words or -1
+// if either has too few words
+func wordSimilarity(wa, wb map[string]bool) float64 {
+	if len(wa) < duplicateMinWords || len(wb) < duplicateMinWords {
+		return -1
+	}
+
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wa)+len(wb)-common)
+}
+
+// Duplicate is an image that is likely a duplicate of another
+type Duplicate struct {
+	Image Image
+
+	// Distance is the number of differing bits of the perceptual hashes
+	// or -1 if either image has no hash
+	Distance int
+
+	// Similarity is the similarity of the texts from 0 to 1 or -1 if they
+	// were not compared
+	Similarity float64
+}
+
+// dupImage is an image with its parsed hash and its words, so they are
+// computed only once when the image is compared to many others
+type dupImage struct {
+	*Image
+	hash   uint64
+	hashed bool
+	words  map[string]bool
+}
+
+func newDupImage(img *Image) *dupImage {
+	hash, hashed := parseHash(img.PHash)
+	return &dupImage{img, hash, hashed, textWords(img.Text)}
+}
+
+// isDuplicate compares the images. Images whose hashes are far apart are
+// not duplicates and their texts are not compared. Otherwise they are
+// duplicates if their texts are nearly the same, or if their hashes are
+// near and their texts are similar enough if they could be compared.
+func isDuplicate(a, b *dupImage) (ret Duplicate, ok bool) {
+	ret.Distance, ret.Similarity = -1, -1
+	hashed := a.hashed && b.hashed
+	if hashed {
+		ret.Distance = bits.OnesCount64(a.hash ^ b.hash)
+		if ret.Distance > duplicateDistance {
+			return
+		}
+	}
+
+	ret.Similarity = wordSimilarity(a.words, b.words)
+	ok = ret.Similarity >= duplicateTextSimilarity ||
+		(hashed && (ret.Similarity < 0 || ret.Similarity >= duplicateSimilarity))
+	return
+}
+
+// getImageHashes returns the ids and the perceptual hashes of all images
+func (db *db) getImageHashes() (ret []Image, err error) {
+	err = db.Select(&ret, "SELECT id, phash FROM image ORDER BY id")
+	return
+}
+
+// FindDuplicates returns the other images that are likely duplicates of the
+// image. Only the images whose hashes are near the image's hash or that
+// have no hash are loaded and compared.
+func FindDuplicates(db *db, img *Image) (ret []Duplicate, err error) {
+	hashes, err := db.getImageHashes()
+	if err != nil {
+		return
+	}
+
+	target := newDupImage(img)
+	for _, h := range hashes {
+		if h.Id == img.Id {
+			continue
+		}
+		if distance, ok := hashDistance(img.PHash, h.PHash); ok && distance > duplicateDistance {
+			continue
+		}
+
+		var other Image
+		other, err = db.getImage(h.Id)
+		if err != nil {
+			return
+		}
+		if d, ok := isDuplicate(target, newDupImage(&other)); ok {
+			d.Image = other
+			ret = append(ret, d)
+		}
+	}
+	return
+}
+
+// warnDuplicates adds a warning of each likely duplicate of the image
+func warnDuplicates(img *Image, db *db) (err error) {
+	dups, err := FindDuplicates(db, img)
+	if err != nil {
+		return
+	}
+	for _, d := range dups {
+		msg := fmt.Sprintf("Possible duplicate of image %d", d.Image.Id)
+		switch {
+		case d.Distance >= 0 && d.Similarity >= 0:
+			msg += fmt.Sprintf(" (hash distance %d, text similarity %.0f%%)",
+				d.Distance, d.Similarity*100)
+		case d.Distance >= 0:
+			msg += fmt.Sprintf(" (hash distance %d)", d.Distance)
+		default:
+			msg += fmt.Sprintf(" (text similarity %.0f%%)", d.Similarity*100)
+		}
+		addWarning(img, msg)
+	}
+	return
+}
+
+// addWarning appends the warning to the image's warnings
+func addWarning(img *Image, warning string) {
+	if img.Warnings != "" {
+		img.Warnings += "\n"
+	}
+	img.Warnings += warning
+}
+
+// DuplicateClusters groups the images that are duplicates of each other
+// directly or through other images. The images without duplicates are left
+// out. The clusters and their images are in the order of the image ids.
+func DuplicateClusters(images []Image) (ret [][]Image) {
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Id < images[j].Id
+	})
+
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	dups := make([]*dupImage, len(images))
+	for i := range images {
+		dups[i] = newDupImage(&images[i])
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if _, ok := isDuplicate(dups[i], dups[j]); ok {
+				ri, rj := find(i), find(j)
+				if ri < rj {
+					parent[rj] = ri
+				} else {
+					parent[ri] = rj
+				}
+			}
+		}
+	}
+
+	clusters := map[int]int{}
+	for i := range images {
+		root := find(i)
+		if root == i {
+			continue
+		}
+		idx, ok := clusters[root]
+		if !ok {
+			idx = len(ret)
+			clusters[root] = idx
+			ret = append(ret, []Image{images[root]})
+		}
+		ret[idx] = append(ret[idx], images[i])
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i][0].Id < ret[j][0].Id
+	})
+	return
+}
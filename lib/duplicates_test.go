@@ -0,0 +1,147 @@
+package paperless
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// testScan draws dark boxes on a white page. The offset and the brightness
+// change simulate a rescan of the same paper.
+func testScan(boxes []image.Rectangle, offset int, brightness uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 300, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 300; x++ {
+			c := 225 + brightness
+			for _, b := range boxes {
+				if image.Pt(x-offset, y-offset).In(b) {
+					c = 40 + brightness
+				}
+			}
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	letter := []image.Rectangle{
+		image.Rect(20, 20, 120, 60),
+		image.Rect(20, 100, 280, 110),
+		image.Rect(20, 130, 250, 140),
+		image.Rect(200, 300, 280, 380),
+	}
+	receipt := []image.Rectangle{
+		image.Rect(100, 10, 200, 390),
+		image.Rect(10, 200, 90, 220),
+	}
+
+	hash := func(img image.Image) string {
+		return fmt.Sprintf("%016x", DHash(img))
+	}
+	orig := hash(testScan(letter, 0, 0))
+	rescan := hash(testScan(letter, 3, 20))
+	other := hash(testScan(receipt, 0, 0))
+
+	if d, ok := hashDistance(orig, rescan); !ok || d > duplicateDistance {
+		t.Errorf("The rescan should be near: distance %d", d)
+	}
+	if d, ok := hashDistance(orig, other); !ok || d <= duplicateDistance {
+		t.Errorf("Another page should be far: distance %d", d)
+	}
+	if _, ok := hashDistance(orig, ""); ok {
+		t.Errorf("An empty hash should not be compared")
+	}
+
+	blank := hash(image.NewGray(image.Rect(0, 0, 100, 100)))
+	if _, ok := hashDistance(blank, blank); ok {
+		t.Errorf("The hash %s of a blank page should not be compared", blank)
+	}
+}
+
+func TestTextSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want float64
+	}{
+		{"Same", "Lasku numero 123 eräpäivä huomenna", "lasku, numero 123. Eräpäivä huomenna!", 1},
+		{"Half", "one two three four five six", "one two three seven eight nine", 1.0 / 3},
+		{"Too few words", "one two three four", "one two three four", -1},
+		{"Short words ignored", "a b c one two three four", "one two three four five", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TextSimilarity(tt.a, tt.b); got != tt.want {
+				t.Errorf("TextSimilarity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	text := "electricity bill for october total amount due"
+	other := "a completely different letter about something else"
+	images := []Image{
+		{Id: 3, PHash: "ffff0000ffff0001", Text: "electricity bill for november total amount due"},
+		{Id: 1, PHash: "ffff0000ffff0000", Text: text},
+		{Id: 2, PHash: "", Text: text},
+		{Id: 4, PHash: "00ff00ff00ff00ff"},
+		{Id: 8, PHash: "0000000000000000"},
+		{Id: 9, PHash: "0000000000000000", Text: ""},
+		{Id: 5, PHash: "0000ffff0000ffff", Text: other},
+		{Id: 6, PHash: "ffff0000ffff0000", Text: other},
+		{Id: 7, PHash: "00ff00ff00ff00fe", Text: ""},
+	}
+
+	var got [][]int
+	for _, c := range DuplicateClusters(images) {
+		var ids []int
+		for _, img := range c {
+			ids = append(ids, img.Id)
+		}
+		got = append(got, ids)
+	}
+
+	// 1 and 2 have the same text, 1 and 3 near hashes and similar texts,
+	// 6 a near hash but a different text, 5 and 6 the same text but far
+	// hashes, 4 and 7 near hashes without texts and 8 and 9 are blank
+	// pages
+	want := [][]int{{1, 2, 3}, {4, 7}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DuplicateClusters() = %v, want %v", got, want)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	for _, img := range []Image{
+		{Checksum: "a", PHash: "ffff0000ffff0000"},
+		{Checksum: "b", PHash: "0000ffff0000ffff"},
+	} {
+		_, err = db.addImage(img)
+		if err != nil {
+			t.Fatalf("Adding an image failed: %v", err)
+		}
+	}
+
+	img, err := db.addImage(Image{Checksum: "c", PHash: "ffff0000ffff0f00"})
+	if err != nil {
+		t.Fatalf("Adding an image failed: %v", err)
+	}
+	err = warnDuplicates(&img, db)
+	if err != nil {
+		t.Fatalf("warnDuplicates() error = %v", err)
+	}
+	want := "Possible duplicate of image 1 (hash distance 4)"
+	if img.Warnings != want {
+		t.Errorf("warnDuplicates() = %q, want %q", img.Warnings, want)
+	}
+}
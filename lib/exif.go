@@ -0,0 +1,109 @@
+package paperless
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	util "github.com/kopoli/go-util"
+)
+
+const (
+	exifIFDPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+	exifTypeASCII        = 2
+	exifTypeLong         = 4
+)
+
+// exifDateTime returns the DateTimeOriginal of the EXIF data of the
+// JPEG image. The time is in the local time zone as EXIF does not record it.
+func exifDateTime(data []byte) (ret time.Time, err error) {
+	tiff, err := jpegExif(data)
+	if err != nil {
+		return
+	}
+	if len(tiff) < 8 {
+		return ret, util.E.New("Truncated EXIF header")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return ret, util.E.New("Invalid EXIF byte order")
+	}
+
+	// The DateTimeOriginal is in the EXIF sub-IFD of the first IFD
+	entry, err := exifEntry(tiff, order, order.Uint32(tiff[4:]), exifIFDPointer)
+	if err != nil {
+		return
+	}
+	if order.Uint16(entry[2:]) != exifTypeLong {
+		return ret, util.E.New("Invalid EXIF IFD pointer")
+	}
+	entry, err = exifEntry(tiff, order, order.Uint32(entry[8:]), exifDateTimeOriginal)
+	if err != nil {
+		return
+	}
+
+	count := order.Uint32(entry[4:])
+	offset := order.Uint32(entry[8:])
+	if order.Uint16(entry[2:]) != exifTypeASCII || count < 19 ||
+		uint64(offset)+uint64(count) > uint64(len(tiff)) {
+		return ret, util.E.New("Invalid EXIF DateTimeOriginal")
+	}
+	value := string(bytes.TrimRight(tiff[offset:offset+count], "\x00"))
+
+	ret, err = time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	if err != nil {
+		err = util.E.Annotate(err, "Invalid EXIF DateTimeOriginal")
+	}
+	return
+}
+
+// jpegExif returns the TIFF structure of the EXIF segment of the JPEG
+func jpegExif(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, util.E.New("Not a JPEG image")
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		// The image data starts after the start of scan
+		if marker == 0xda || length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		pos += 2 + length
+	}
+	return nil, util.E.New("No EXIF data")
+}
+
+// exifEntry returns the 12 bytes of the tag's entry in the IFD at offset
+func exifEntry(tiff []byte, order binary.ByteOrder, offset uint32, tag uint16) ([]byte, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, util.E.New("Invalid EXIF IFD offset")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		if order.Uint16(entry) == tag {
+			return entry, nil
+		}
+	}
+	return nil, util.E.New("EXIF tag %#x not found", tag)
+}
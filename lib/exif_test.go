@@ -0,0 +1,70 @@
+package paperless
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// exifJPEG creates the beginning of a JPEG with the DateTimeOriginal in its
+// EXIF data
+func exifJPEG(order binary.ByteOrder, datetime string) []byte {
+	tiff := &bytes.Buffer{}
+	w := func(v interface{}) { _ = binary.Write(tiff, order, v) }
+
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	w(uint16(42))
+	w(uint32(8))
+
+	// IFD0 with the pointer to the EXIF IFD at 26
+	w(uint16(1))
+	w([]uint16{exifIFDPointer, exifTypeLong})
+	w([]uint32{1, 26})
+	w(uint32(0))
+
+	// The EXIF IFD with the DateTimeOriginal at 44
+	value := append([]byte(datetime), 0)
+	w(uint16(1))
+	w([]uint16{exifDateTimeOriginal, exifTypeASCII})
+	w([]uint32{uint32(len(value)), 44})
+	w(uint32(0))
+	tiff.Write(value)
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	ret := []byte{0xff, 0xd8, 0xff, 0xe1}
+	ret = append(ret, byte((len(segment)+2)>>8), byte(len(segment)+2))
+	ret = append(ret, segment...)
+	return append(ret, 0xff, 0xda, 0, 2)
+}
+
+func Test_exifDateTime(t *testing.T) {
+	want := time.Date(2026, 10, 17, 13, 14, 15, 0, time.Local)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"Little endian", exifJPEG(binary.LittleEndian, "2026:10:17 13:14:15"), false},
+		{"Big endian", exifJPEG(binary.BigEndian, "2026:10:17 13:14:15"), false},
+		{"Invalid date", exifJPEG(binary.BigEndian, "2026-10-17 13:14:15"), true},
+		{"No EXIF", []byte{0xff, 0xd8, 0xff, 0xda, 0, 2}, true},
+		{"Not a JPEG", []byte("\x89PNG"), true},
+		{"Truncated", exifJPEG(binary.LittleEndian, "2026:10:17 13:14:15")[:20], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := exifDateTime(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exifDateTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(want) {
+				t.Errorf("exifDateTime() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -2,18 +2,24 @@ package paperless
 
 import (
 	"bytes"
+	"database/sql"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	util "github.com/kopoli/go-util"
 )
 
-// SaveImage saves the image to db and starts to process it
+// SaveImage saves the image to db and starts to process it. The problems
+// of the quality of the image are added to its warnings.
 func SaveImage(filename string, data []byte, db *db, destdir string, tags string) (ret Image, err error) {
 
 	supportedTypes := map[string]string{
@@ -29,9 +35,22 @@ func SaveImage(filename string, data []byte, db *db, destdir string, tags string
 		return
 	}
 
+	quality, err := CheckQuality(data)
+	if err != nil {
+		addWarning(&ret, "The quality could not be checked: "+err.Error())
+		err = nil
+	}
+	for _, w := range quality.Warnings {
+		addWarning(&ret, w)
+	}
+
 	ret.Checksum = Checksum(data)
 	ret.AddDate = time.Now()
-	ret.ScanDate = time.Now() // TODO
+	ret.ScanDate, err = exifDateTime(data)
+	if err != nil {
+		ret.ScanDate = time.Now()
+		err = nil
+	}
 	ret.Filename = filename
 
 	taglist := strings.Split(tags, ",")
@@ -63,53 +82,412 @@ func SaveImage(filename string, data []byte, db *db, destdir string, tags string
 	return
 }
 
-func ProcessImage(img *Image, scriptname string, db *db, destdir string) (err error) {
-	script := `
+// UploadPage is a page of a batch upload
+type UploadPage struct {
+	Filename string
+	Data     []byte
+}
+
+// SaveBatch saves and processes the pages of an upload in order. The
+// separator sheets are removed and each starts a new document. The blank
+// pages are kept, skipped or the whole batch is rejected depending on the
+// BlankPages setting before they are processed. A page with barcodes is not
+// considered blank, so a separator sheet with only a small code is not
+// removed as a blank page.
+// The likely duplicates of the pages are added to their warnings. The pages
+// of a document get the id of its first page as their Document. The tags,
+// the script parameters and the document date, if it is not zero, are given
+// to all pages. On failure the saved pages are removed.
+func SaveBatch(pages []UploadPage, tags, params string, date time.Time, conf *ProcessConfig, db *db, destdir string) (ret []Image, err error) {
+	var saved []Image
+	defer func() {
+		if err != nil {
+			for i := range saved {
+				// Ignore errors with this as the data could be
+				// incomplete before deletion
+				_ = DeleteImage(&saved[i], db, destdir)
+			}
+			ret = nil
+		}
+	}()
+
+	ret = []Image{}
+	document := 0
+	for _, p := range pages {
+		var img Image
+		img, err = SaveImage(p.Filename, p.Data, db, destdir, tags)
+		if err != nil {
+			return
+		}
+		saved = append(saved, img)
+
+		if (conf.BlankPages == BlankPagesSkip || conf.BlankPages == BlankPagesReject) &&
+			hasString(img.WarningList(), WarningBlank) {
+			var results map[string]string
+			_, results, err = runScript(&img, blankPageScript, "blank page", conf, nil, destdir)
+			if err != nil {
+				err = util.E.Annotate(err, "Could not check the blank page ", p.Filename)
+				return
+			}
+
+			// The blank pages with barcodes are processed as
+			// usual
+			if results["barcodes"] == "" {
+				if conf.BlankPages == BlankPagesReject {
+					err = util.E.New("Page %s is blank", p.Filename)
+					return
+				}
+				saved = saved[:len(saved)-1]
+				err = DeleteImage(&img, db, destdir)
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		img.Params = params
+		if !date.IsZero() {
+			img.DocumentDate = date
+			img.DateSource = DateSourceExplicit
+		}
+		err = ProcessImage(&img, "default", conf, db, destdir)
+		if err != nil {
+			err = util.E.Annotate(err, "Could not process image ", p.Filename)
+			return
+		}
+
+		if conf.IsSeparator(&img) {
+			saved = saved[:len(saved)-1]
+			err = DeleteImage(&img, db, destdir)
+			if err != nil {
+				return
+			}
+			document = 0
+			continue
+		}
+
+		err = warnDuplicates(&img, db)
+		if err != nil {
+			err = util.E.Annotate(err, "Finding the duplicates failed")
+			return
+		}
+		if img.Warnings != "" {
+			err = db.updateImage(img)
+			if err != nil {
+				return
+			}
+		}
+
+		if conf.AutoASN && img.ASN == 0 {
+			err = db.assignASN(&img)
+			if err != nil {
+				err = util.E.Annotate(err, "Assigning the archive serial number failed")
+				return
+			}
+		}
+
+		if len(pages) > 1 {
+			if document == 0 {
+				document = img.Id
+			}
+			img.Document = document
+			err = db.updateImage(img)
+			if err != nil {
+				return
+			}
+		}
+		saved[len(saved)-1] = img
+		ret = append(ret, img)
+	}
+	return
+}
+
+// defaultScript is the processing script that is used for new images
+const defaultScript = `
+# param lang=fin
+# param papersize=a4
+# param ocrengine=tesseract
+# param languages=fin,swe,eng
+
 unpaper --version
 convert -version
-tesseract --version
+
+-@barcodes $input $tmpBarcodes
 
 convert -depth 8 $input pnm:$tmpUnpaper.pnm
 
-unpaper -vv -s a4 -l single -dv 3.0 -dr 80.0 --overwrite $tmpUnpaper.pnm $tmpConvert
+unpaper -vv -s $papersize -l single -dv 3.0 -dr 80.0 --overwrite $tmpUnpaper.pnm $tmpConvert
+
+$rotate = @orientation engine=$ocrengine $tmpConvert
+convert -rotate $rotate pnm:$tmpConvert pnm:$tmpRotated
 
-convert -normalize -colorspace Gray pnm:$tmpConvert pnm:$tmpTesseract
+convert -normalize -colorspace Gray pnm:$tmpRotated pnm:$tmpTesseract
 
-tesseract -l fin -psm 1 $tmpTesseract stdout > $contents
+@ocr engine=$ocrengine lang=$lang languages=$languages psm=1 $tmpTesseract $contents
+@invoice $contents
 
-convert -trim -quality 80% +repage -type optimize pnm:$tmpConvert $cleanout
+convert -trim -quality 80% +repage -type optimize pnm:$tmpRotated $cleanout
 
-convert -trim -quality 80% +repage -type optimize -thumbnail 200x200> pnm:$tmpConvert $thumbout
+@thumbnail $cleanout $thumbout 200x200
 
 `
 
+// blankPageScript only decodes the barcodes of a blank page to find out if
+// it is a separator sheet or a page with a label before it is skipped or
+// rejected
+const blankPageScript = `
+-@barcodes $input $tmpBarcodes
+`
+
+// ProcessConfig contains the settings for running the processing scripts
+type ProcessConfig struct {
+	// Sandbox for the processing commands. If nil, the commands are not
+	// sandboxed.
+	Sandbox *Sandbox
+
+	// Policy for the commands and their arguments
+	Policy *Policy
+
+	// Cache for the outputs of the commands. If nil, the commands are
+	// always run.
+	Cache *StepCache
+
+	// MaxParallel is the maximum number of the commands of a script that
+	// are run at the same time. If not positive, it is the number of CPUs.
+	MaxParallel int
+
+	// ReviewThreshold is the OCR confidence from 0 to 100 below which the
+	// images need a review
+	ReviewThreshold float64
+
+	// SeparatorCode is the barcode of the separator sheets of a batch. If
+	// empty, the batches are not split.
+	SeparatorCode string
+
+	// ASNPattern matches the barcodes of the archive serial numbers. The
+	// first group is the number. If nil, the numbers are not assigned.
+	ASNPattern *regexp.Regexp
+
+	// AutoASN assigns the next archive serial number to the uploaded
+	// images that did not get one from a barcode
+	AutoASN bool
+
+	// BlankPages tells how the blank pages of the uploads are handled:
+	// BlankPagesKeep, BlankPagesSkip or BlankPagesReject
+	BlankPages string
+}
+
+// ValidBlankPages tells if the value is a valid BlankPages setting
+func ValidBlankPages(value string) bool {
+	return hasString([]string{BlankPagesKeep, BlankPagesSkip, BlankPagesReject}, value)
+}
+
+// NewProcessConfig creates the processing settings from the options
+func NewProcessConfig(o util.Options) (ret ProcessConfig, err error) {
+	if o.IsSet("command-policy") {
+		ret.Policy, err = LoadPolicy(o.Get("command-policy", ""))
+	} else {
+		ret.Policy, err = ParsePolicy(DefaultPolicy)
+	}
+	if err != nil {
+		return
+	}
+
+	if o.IsSet("sandbox") {
+		var cpu, mem, output int
+		cpu, err = strconv.Atoi(o.Get("sandbox-cpu", "0"))
+		if err == nil {
+			mem, err = strconv.Atoi(o.Get("sandbox-memory", "0"))
+		}
+		if err == nil {
+			output, err = strconv.Atoi(o.Get("sandbox-output", "0"))
+		}
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid sandbox limit")
+			return
+		}
+
+		ret.Sandbox = &Sandbox{
+			CPUTime:    time.Duration(cpu) * time.Second,
+			Memory:     uint64(mem) * 1024 * 1024,
+			OutputSize: uint64(output) * 1024 * 1024,
+		}
+		err = ret.Sandbox.validate()
+		if err != nil {
+			return
+		}
+	}
+
+	ret.MaxParallel, err = strconv.Atoi(o.Get("max-parallel", "0"))
+	if err != nil {
+		err = util.E.Annotate(err, "Invalid maximum number of parallel commands")
+		return
+	}
+
+	ret.ReviewThreshold, err = strconv.ParseFloat(o.Get("review-threshold", "0"), 64)
+	if err != nil {
+		err = util.E.Annotate(err, "Invalid review threshold")
+		return
+	}
+
+	ret.SeparatorCode = o.Get("separator-code", "")
+	ret.AutoASN = o.IsSet("asn-auto")
+	ret.BlankPages = o.Get("blank-pages", BlankPagesKeep)
+	if !ValidBlankPages(ret.BlankPages) {
+		err = util.E.New("Invalid blank page handling: %s", ret.BlankPages)
+		return
+	}
+	if o.IsSet("asn-pattern") {
+		ret.ASNPattern, err = regexp.Compile(o.Get("asn-pattern", ""))
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid ASN pattern")
+			return
+		}
+		if ret.ASNPattern.NumSubexp() < 1 {
+			err = util.E.New("The ASN pattern has no group for the number")
+			return
+		}
+	}
+
+	if o.IsSet("cache-dir") {
+		var size int
+		size, err = strconv.Atoi(o.Get("cache-size", "0"))
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid cache size")
+			return
+		}
+		ret.Cache, err = NewStepCache(o.Get("cache-dir", ""), int64(size)*1024*1024)
+	}
+	return
+}
+
+// PurgeCache removes the cached outputs of the commands
+func PurgeCache(o util.Options) error {
+	if !o.IsSet("cache-dir") {
+		return util.E.New("The cache directory is not given")
+	}
+	sc := &StepCache{Dir: o.Get("cache-dir", "")}
+	return sc.Purge()
+}
+
+// tagParams collects the script parameters of the image's tags from the
+// database. The later tags override the earlier ones.
+func tagParams(img *Image, db *db) (ret map[string]string, err error) {
+	ret = map[string]string{}
+	for _, t := range img.Tags {
+		tag, e2 := db.getTagByName(t.Name)
+		if e2 != nil {
+			continue
+		}
+		var p map[string]string
+		p, err = ParseParams(tag.Params)
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid parameters in tag ", tag.Name)
+			return
+		}
+		for k, v := range p {
+			ret[k] = v
+		}
+	}
+	return
+}
+
+// imageConstants returns the constants given to the processing script of
+// the image
+func imageConstants(img *Image, destdir string) map[string]string {
+	return map[string]string{
+		"input":    img.OrigFile(destdir),
+		"contents": img.TxtFile(destdir),
+		"cleanout": img.CleanFile(destdir),
+		"thumbout": img.ThumbFile(destdir),
+	}
+}
+
+// runScript runs the processing script for the image. The original image is
+// read from destdir and rotated by the manual rotation of the image. The
+// generated files are written to destdir. The parameters are taken from the
+// tagparams the script declares and from the image's own Params. Returns the
+// processing log and the results the commands reported.
+func runScript(img *Image, script, scriptname string, conf *ProcessConfig, tagparams map[string]string, destdir string) (log string, results map[string]string, err error) {
 	ch, err := NewCmdChainScript(script)
 	if err != nil {
 		return
 	}
+	ch.MaxParallel = conf.MaxParallel
+	if ch.MaxParallel <= 0 {
+		ch.MaxParallel = runtime.NumCPU()
+	}
+
+	params := map[string]string{}
+	for k, v := range tagparams {
+		if _, ok := ch.Params[k]; ok {
+			params[k] = v
+		}
+	}
+	explicit, err := ParseParams(img.Params)
+	if err != nil {
+		return
+	}
+	for k, v := range explicit {
+		params[k] = v
+	}
 
 	buf := &bytes.Buffer{}
 	s := Status{
 		Environment: ch.Environment,
 		Log:         buf,
+		Results:     &Results{},
 	}
-	s.Constants = map[string]string{
-		"input":    img.OrigFile(destdir),
-		"contents": img.TxtFile(destdir),
-		"cleanout": img.CleanFile(destdir),
-		"thumbout": img.ThumbFile(destdir),
+	s.Constants = imageConstants(img, destdir)
+	if img.Rotation != 0 {
+		var rotated string
+		rotated, err = rotatedOriginal(img, destdir)
+		if err != nil {
+			return
+		}
+		defer os.Remove(rotated)
+		s.Constants["input"] = rotated
+	}
+	s.Inputs = []string{"input"}
+	s.Outputs = []string{"contents", "cleanout", "thumbout"}
+	if conf.Policy != nil {
+		s.AllowedCommands = conf.Policy.AllowedCommands()
+		s.Policy = conf.Policy
 	}
-	s.AllowedCommands = map[string]bool{
-		"convert":   true,
-		"unpaper":   true,
-		"tesseract": true,
-		"file":      true,
-		"cat":       true,
+	s.Sandbox = conf.Sandbox
+	s.Cache = conf.Cache
+
+	err = ch.SetParams(&s, params)
+	if err != nil {
+		return
 	}
 
 	fmt.Fprintln(s.Log, "# Running the script named:", scriptname)
 
 	err = RunCmdChain(ch, &s)
+	log = buf.String()
+	results = s.Results.Values()
+	return
+}
+
+// ProcessImage runs the named script from the database for the image. If the
+// script is not in the database, the default script is run. The script and
+// its version are recorded to the image.
+func ProcessImage(img *Image, scriptname string, conf *ProcessConfig, db *db, destdir string) (err error) {
+	script, err := db.getScriptByName(scriptname)
+	if err == sql.ErrNoRows {
+		script = Script{Name: scriptname, Script: defaultScript}
+	} else if err != nil {
+		return
+	}
+
+	params, err := tagParams(img, db)
+	if err != nil {
+		return
+	}
+
+	log, results, err := runScript(img, script.Script, script.Name, conf, params, destdir)
 	if err != nil {
 		return
 	}
@@ -121,13 +499,213 @@ convert -trim -quality 80% +repage -type optimize -thumbnail 200x200> pnm:$tmpCo
 	}
 
 	img.InterpretDate = time.Now()
-	img.ProcessLog = buf.String()
+	img.ProcessLog = log
 	img.Text = string(data)
+	img.ScriptName = script.Name
+	img.ScriptVersion = script.Version
+	img.Orientation = 0
+	img.WritingScript = results["writingscript"]
+	if v, ok := results["orientation"]; ok {
+		img.Orientation, err = strconv.Atoi(v)
+		if err != nil {
+			return util.E.Annotate(err, "Invalid orientation result")
+		}
+	}
+	img.Language = results["language"]
+	img.Barcodes = results["barcodes"]
+	if asn := conf.ASN(img.Barcodes); asn != 0 && asn != img.ASN {
+		other, e2 := db.getImageByASN(asn)
+		if e2 != nil && e2 != sql.ErrNoRows {
+			return util.E.Annotate(e2, "Getting the image of the archive serial number failed")
+		}
+		if e2 == nil && other.Id != img.Id {
+			img.ProcessLog += fmt.Sprintf("# The archive serial number %d is already used by image %d\n",
+				asn, other.Id)
+		} else {
+			img.ASN = asn
+		}
+	}
+	setDocumentDate(img, destdir)
+	setPHash(img, destdir)
+	err = setInvoice(img, results)
+	if err != nil {
+		return
+	}
+	err = setConfidence(img, results, conf.ReviewThreshold)
+	if err != nil {
+		return
+	}
 
 	err = db.updateImage(*img)
 	return
 }
 
+// ASN returns the archive serial number of the first of the newline
+// separated barcodes that matches the ASNPattern or 0
+func (c *ProcessConfig) ASN(barcodes string) int {
+	if c.ASNPattern == nil {
+		return 0
+	}
+	for _, code := range strings.Split(barcodes, "\n") {
+		m := c.ASNPattern.FindStringSubmatch(code)
+		if m == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// IsSeparator tells if the image is a separator sheet of a batch
+func (c *ProcessConfig) IsSeparator(img *Image) bool {
+	return c.SeparatorCode != "" &&
+		hasString(strings.Split(img.Barcodes, "\n"), c.SeparatorCode)
+}
+
+// setDocumentDate sets the document date from the text or from the EXIF
+// data of the original unless it was given explicitly
+func setDocumentDate(img *Image, destdir string) {
+	if img.DateSource == DateSourceExplicit {
+		return
+	}
+
+	img.DocumentDate, img.DateSource = time.Time{}, ""
+	if date, ok := ExtractDocumentDate(img.Text, time.Now()); ok {
+		img.DocumentDate, img.DateSource = date, DateSourceText
+		return
+	}
+
+	data, err := ioutil.ReadFile(img.OrigFile(destdir))
+	if err != nil {
+		return
+	}
+	if date, err := exifDateTime(data); err == nil {
+		img.DocumentDate, img.DateSource = date, DateSourceExif
+	}
+}
+
+// setConfidence stores the OCR confidence the script reported to the image.
+// The image needs a review if its text is empty or if the confidence is
+// below the threshold.
+func setConfidence(img *Image, results map[string]string, threshold float64) (err error) {
+	img.Confidence, img.MinConfidence = 0, 0
+	_, reported := results["confidence"]
+	for name, dst := range map[string]*float64{
+		"confidence":    &img.Confidence,
+		"minconfidence": &img.MinConfidence,
+	} {
+		if v, ok := results[name]; ok {
+			*dst, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return util.E.Annotate(err, "Invalid ", name, " result")
+			}
+		}
+	}
+
+	img.NeedsReview = strings.TrimSpace(img.Text) == "" ||
+		(reported && img.Confidence < threshold)
+	return
+}
+
+// TrialResult is the outcome of running a script on a copy of an image
+type TrialResult struct {
+	// The text the script produced
+	Text string
+
+	// Unified diff from the current text of the image to Text
+	Diff string
+
+	// Paths to the generated clean image and thumbnail
+	CleanFile string
+	ThumbFile string
+
+	// The processing log
+	Log string
+
+	// The results the commands reported, e.g. "orientation"
+	Results map[string]string
+}
+
+// TrialScript runs the script on a copy of the image's original in a new
+// directory under trialdir. The parameters of the image's tags are read from
+// the database, but neither the database nor the image directory is
+// modified. The generated files are left in the new directory.
+func TrialScript(img *Image, script Script, conf *ProcessConfig, db *db, imgdir, trialdir string) (ret TrialResult, err error) {
+	params, err := tagParams(img, db)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(trialdir, 0755)
+	if err != nil {
+		return
+	}
+
+	scratch, err := ioutil.TempDir(trialdir, "trial")
+	if err != nil {
+		err = util.E.Annotate(err, "Creating a trial directory failed")
+		return
+	}
+
+	data, err := ioutil.ReadFile(img.OrigFile(imgdir))
+	if err != nil {
+		err = util.E.Annotate(err, "Reading the original image failed")
+		return
+	}
+	err = ioutil.WriteFile(img.OrigFile(scratch), data, 0644)
+	if err != nil {
+		err = util.E.Annotate(err, "Copying the original image failed")
+		return
+	}
+
+	ret.Log, ret.Results, err = runScript(img, script.Script, script.Name, conf, params, scratch)
+	if err != nil {
+		return
+	}
+
+	data, err = ioutil.ReadFile(img.TxtFile(scratch))
+	if err != nil {
+		data = []byte{}
+		err = nil
+	}
+
+	ret.Text = string(data)
+	ret.Diff = TextDiff(img.Text, ret.Text)
+	ret.CleanFile = img.CleanFile(scratch)
+	ret.ThumbFile = img.ThumbFile(scratch)
+	return
+}
+
+// CleanTrials removes the trial directories under trialdir that are older
+// than maxAge
+func CleanTrials(trialdir string, maxAge time.Duration) error {
+	infos, err := ioutil.ReadDir(trialdir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ret := util.NewErrorList("Cleaning trial directories failed")
+	for _, info := range infos {
+		if !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(trialdir, info.Name()))
+		if err != nil {
+			ret.Append(err)
+		}
+	}
+
+	if ret.IsEmpty() {
+		return nil
+	}
+	return ret
+}
+
 // DeleteImage deletes the image's files and data from the database
 func DeleteImage(img *Image, db *db, destdir string) error {
 	var err error
@@ -146,8 +724,9 @@ func DeleteImage(img *Image, db *db, destdir string) error {
 	}
 
 	for i := range files {
+		// The processing might not have generated all the files
 		err = os.Remove(files[i])
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			ret.Append(util.E.Annotate(err, "Removing file ", files[i], "failed"))
 		}
 	}
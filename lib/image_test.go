@@ -0,0 +1,85 @@
+package paperless
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrialScript(t *testing.T) {
+	imgdir, err := ioutil.TempDir("", "imgdir")
+	if err != nil {
+		t.Fatalf("Creating image directory failed: %v", err)
+	}
+	defer os.RemoveAll(imgdir)
+	trialdir := filepath.Join(imgdir, "trials")
+
+	img := Image{Id: 1, Fileid: "jpg", Text: "old text\n"}
+	err = ioutil.WriteFile(img.OrigFile(imgdir), []byte("new text\n"), 0644)
+	if err != nil {
+		t.Fatalf("Writing original failed: %v", err)
+	}
+
+	res, err := TrialScript(&img, Script{Name: "trial", Script: "cat $input > $contents"},
+		&ProcessConfig{}, nil, imgdir, trialdir)
+	if err != nil {
+		t.Fatalf("TrialScript() error = %v, log: %s", err, res.Log)
+	}
+
+	if res.Text != "new text\n" {
+		t.Errorf("TrialScript() text = %q, want %q", res.Text, "new text\n")
+	}
+	want := "--- Current\n+++ New\n@@ -1,2 +1,2 @@\n-old text\n+new text\n \n"
+	if res.Diff != want {
+		t.Errorf("TrialScript() diff = %q, want %q", res.Diff, want)
+	}
+	if filepath.Dir(res.CleanFile) == imgdir {
+		t.Errorf("TrialScript() should not output to the image directory")
+	}
+	if _, err = os.Stat(img.TxtFile(imgdir)); err == nil {
+		t.Errorf("TrialScript() should not write to the image directory")
+	}
+
+	err = CleanTrials(trialdir, 0)
+	if err != nil {
+		t.Errorf("CleanTrials() error = %v", err)
+	}
+	infos, _ := ioutil.ReadDir(trialdir)
+	if len(infos) != 0 {
+		t.Errorf("CleanTrials() should remove the trial directories")
+	}
+}
+
+func Test_setConfidence(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		results map[string]string
+		want    Image
+		wantErr bool
+	}{
+		{"Confident", "text", map[string]string{"confidence": "90", "minconfidence": "70.5"},
+			Image{Text: "text", Confidence: 90, MinConfidence: 70.5}, false},
+		{"Below threshold", "text", map[string]string{"confidence": "59.9", "minconfidence": "3"},
+			Image{Text: "text", Confidence: 59.9, MinConfidence: 3, NeedsReview: true}, false},
+		{"Empty text", " \n", map[string]string{"confidence": "95", "minconfidence": "95"},
+			Image{Text: " \n", Confidence: 95, MinConfidence: 95, NeedsReview: true}, false},
+		{"Not reported", "text", map[string]string{},
+			Image{Text: "text"}, false},
+		{"Invalid", "text", map[string]string{"confidence": "high"},
+			Image{Text: "text"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := Image{Text: tt.text, Confidence: 1, NeedsReview: true}
+			err := setConfidence(&img, tt.results, 60)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setConfidence() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				compare(t, "setConfidence() not expected", tt.want, img)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package paperless
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	util "github.com/kopoli/go-util"
+)
+
+// Invoice contains the payment details of a bill
+type Invoice struct {
+	IBAN string
+
+	// Reference is the Finnish reference number (viitenumero) and
+	// CreditorReference the international RF reference
+	Reference         string
+	CreditorReference string
+
+	// DueDate is the due date of the bill or the expiry date of another
+	// document, e.g. a warranty. It is at midnight UTC.
+	DueDate time.Time
+
+	// Amount is in cents
+	Amount int64
+
+	// Paid is set by the user
+	Paid bool
+}
+
+// IsInvoice tells if the payment details of a bill were found
+func (i *Invoice) IsInvoice() bool {
+	return i.IBAN != "" || i.Reference != "" || i.CreditorReference != ""
+}
+
+// The lengths of the IBANs of the countries of the SEPA area
+var ibanLengths = map[string]int{
+	"AT": 20, "BE": 16, "BG": 22, "CH": 21, "CY": 28, "CZ": 24, "DE": 22,
+	"DK": 18, "EE": 20, "ES": 24, "FI": 18, "FR": 27, "GB": 22, "GR": 27,
+	"HR": 21, "HU": 28, "IE": 22, "IS": 26, "IT": 27, "LI": 21, "LT": 20,
+	"LU": 20, "LV": 21, "MT": 31, "NL": 18, "NO": 15, "PL": 28, "PT": 25,
+	"RO": 24, "SE": 24, "SI": 19, "SK": 24,
+}
+
+var (
+	ibanRe        = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+	referenceRe   = regexp.MustCompile(`(?i)\b(?:viite(?:numero|nro)?|viitteen|ref(?:erence|\.)?|referens(?:nummer)?)\W*((?:\d ?){4,20})`)
+	rfRe          = regexp.MustCompile(`\bRF\d{2}(?: ?[A-Z0-9]){1,21}\b`)
+	dueKeywordRe  = regexp.MustCompile(`(?i)(eräpäivä|erääntyy|due date|förfallodag(?:en)?)`)
+	amountKeyword = regexp.MustCompile(`(?i)(yhteensä|maksettava|summa|euroa|total|amount|att betala|belopp)`)
+	amountRe      = regexp.MustCompile(`\b(\d{1,3}(?:[ .]\d{3})*|\d+)[,.](\d{2})\b`)
+)
+
+// mod97 calculates the ISO 7064 checksum used in the IBAN and the RF
+// reference. The letters are converted to the numbers from 10 to 35.
+func mod97(s string) (int, bool) {
+	digits := &strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			digits.WriteString(strconv.Itoa(int(r-'A') + 10))
+		default:
+			return 0, false
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok {
+		return 0, false
+	}
+	return int(new(big.Int).Mod(n, big.NewInt(97)).Int64()), true
+}
+
+// ValidIBAN tells if the IBAN without spaces has a valid checksum and length
+func ValidIBAN(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	if l, ok := ibanLengths[iban[:2]]; ok && l != len(iban) {
+		return false
+	}
+	sum, ok := mod97(iban[4:] + iban[:4])
+	return ok && sum == 1
+}
+
+// ValidReference tells if the Finnish reference number has a valid check
+// digit. The digits are weighted with 7, 3 and 1 from the right and the
+// check digit completes their sum to the next multiple of ten.
+func ValidReference(ref string) bool {
+	if len(ref) < 4 || len(ref) > 20 {
+		return false
+	}
+	weights := []int{7, 3, 1}
+	sum := 0
+	for i := len(ref) - 2; i >= 0; i-- {
+		if ref[i] < '0' || ref[i] > '9' {
+			return false
+		}
+		sum += int(ref[i]-'0') * weights[(len(ref)-2-i)%3]
+	}
+	check := ref[len(ref)-1]
+	return check >= '0' && check <= '9' && int(check-'0') == (10-sum%10)%10
+}
+
+// ValidCreditorReference tells if the RF reference has a valid checksum
+func ValidCreditorReference(ref string) bool {
+	if len(ref) < 5 || len(ref) > 25 || !strings.HasPrefix(ref, "RF") {
+		return false
+	}
+	sum, ok := mod97(ref[4:] + ref[:4])
+	return ok && sum == 1
+}
+
+// removeSpaces removes the spaces the numbers are grouped with
+func removeSpaces(s string) string {
+	return strings.Replace(s, " ", "", -1)
+}
+
+// findChecked returns the first match of the regexp that is valid without
+// its spaces. As the match may continue to the following words, its leading
+// space separated groups are tried as well, the longest first. A group is
+// never cut, so a wrong number is not accepted by dropping its last digits.
+func findChecked(re *regexp.Regexp, text string, group int, valid func(string) bool) string {
+	for _, m := range re.FindAllStringSubmatch(text, -1) {
+		groups := strings.Fields(m[group])
+		for n := len(groups); n > 0; n-- {
+			if s := strings.Join(groups[:n], ""); valid(s) {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// parseAmount parses the euros and cents of an amount
+func parseAmount(euros, cents string) (int64, error) {
+	euros = strings.NewReplacer(" ", "", ".", "").Replace(euros)
+	e, err := strconv.ParseInt(euros, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	c, err := strconv.ParseInt(cents, 10, 64)
+	return e*100 + c, err
+}
+
+// ExtractInvoice finds the payment details of a bill from its text. The
+// IBAN and the references are accepted only with valid checksums. The due
+// date and the amount are searched from the lines with a keyword.
+func ExtractInvoice(text string) (ret Invoice) {
+	ret.IBAN = findChecked(ibanRe, text, 0, ValidIBAN)
+	ret.Reference = findChecked(referenceRe, text, 1, ValidReference)
+	ret.CreditorReference = findChecked(rfRe, text, 0, ValidCreditorReference)
+
+	for _, line := range strings.Split(text, "\n") {
+		if ret.DueDate.IsZero() {
+			if loc := dueKeywordRe.FindStringIndex(line); loc != nil {
+				if dates := findDates(line[loc[1]:]); len(dates) > 0 {
+					d := dates[0].date
+					ret.DueDate = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+				}
+			}
+		}
+		if ret.Amount == 0 {
+			if loc := amountKeyword.FindStringIndex(line); loc != nil {
+				if m := amountRe.FindStringSubmatch(line[loc[1]:]); m != nil {
+					ret.Amount, _ = parseAmount(m[1], m[2])
+				}
+			}
+		}
+	}
+	return
+}
+
+func init() {
+	RegisterBuiltin("invoice", 1, 1, builtinInvoice)
+}
+
+// @invoice TEXTFILE finds the payment details of a bill from the text. They
+// are reported as the results "iban", "reference", "creditorreference",
+// "duedate" (YYYY-MM-DD) and "amount" (in cents).
+func builtinInvoice(s *Status, args []string, stdout io.Writer) error {
+	path, err := s.filePath(args[0], false)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return util.E.Annotate(err, "Reading the text failed")
+	}
+
+	inv := ExtractInvoice(string(data))
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "# Invoice: IBAN %q, reference %q, RF %q, due %s, amount %d\n",
+			inv.IBAN, inv.Reference, inv.CreditorReference,
+			inv.DueDate.Format("2006-01-02"), inv.Amount)
+	}
+
+	results := map[string]string{
+		"iban":              inv.IBAN,
+		"reference":         inv.Reference,
+		"creditorreference": inv.CreditorReference,
+	}
+	if !inv.DueDate.IsZero() {
+		results["duedate"] = inv.DueDate.Format("2006-01-02")
+	}
+	if inv.Amount != 0 {
+		results["amount"] = strconv.FormatInt(inv.Amount, 10)
+	}
+	for k, v := range results {
+		if v != "" {
+			s.SetResult(k, v)
+		}
+	}
+	return nil
+}
+
+// setInvoice stores the payment details the script reported to the image.
+// The paid state and an explicitly given due date are kept.
+func setInvoice(img *Image, results map[string]string) (err error) {
+	old := img.Invoice
+	img.Invoice = Invoice{
+		IBAN:              results["iban"],
+		Reference:         results["reference"],
+		CreditorReference: results["creditorreference"],
+		Paid:              old.Paid,
+	}
+	if img.DueSource == DateSourceExplicit {
+		img.DueDate = old.DueDate
+		return setAmount(img, results)
+	}
+
+	img.DueSource = ""
+	if v, ok := results["duedate"]; ok {
+		img.DueDate, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return util.E.Annotate(err, "Invalid duedate result")
+		}
+		img.DueSource = DateSourceText
+	}
+	return setAmount(img, results)
+}
+
+func setAmount(img *Image, results map[string]string) (err error) {
+	if v, ok := results["amount"]; ok {
+		img.Amount, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return util.E.Annotate(err, "Invalid amount result")
+		}
+	}
+	return
+}
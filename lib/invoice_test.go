@@ -0,0 +1,108 @@
+package paperless
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvoiceChecksums(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid func(string) bool
+		value string
+		want  bool
+	}{
+		{"Finnish IBAN", ValidIBAN, "FI2112345600000785", true},
+		{"Swedish IBAN", ValidIBAN, "SE4550000000058398257466", true},
+		{"Invalid IBAN checksum", ValidIBAN, "FI2112345600000786", false},
+		{"Invalid IBAN length", ValidIBAN, "FI211234560000078", false},
+		{"Reference", ValidReference, "1232", true},
+		{"Long reference", ValidReference, "123456789012345", true},
+		{"Invalid reference check digit", ValidReference, "1233", false},
+		{"Too short reference", ValidReference, "12", false},
+		{"RF reference", ValidCreditorReference, "RF18539007547034", true},
+		{"Short RF reference", ValidCreditorReference, "RF712348231", true},
+		{"Invalid RF reference", ValidCreditorReference, "RF19539007547034", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.valid(tt.value); got != tt.want {
+				t.Errorf("valid(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractInvoice(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Invoice
+	}{
+		{"Finnish bill", `Sähkö Oy
+Saajan tilinumero FI21 1234 5600 0007 85 NDEAFIHH
+Viitenumero 1234 5672
+Eräpäivä 31.10.2026
+Yhteensä 1 234,50 EUR
+`, Invoice{
+			IBAN:      "FI2112345600000785",
+			Reference: "12345672",
+			DueDate:   time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC),
+			Amount:    123450,
+		}},
+		{"RF reference", "IBAN SE45 5000 0000 0583 9825 7466\nReference RF18 5390 0754 7034\nDue date 2026-11-01\nTotal 99.90",
+			Invoice{
+				IBAN:              "SE4550000000058398257466",
+				CreditorReference: "RF18539007547034",
+				DueDate:           time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+				Amount:            9990,
+			}},
+		{"Invalid checksums", "FI21 1234 5600 0007 86\nViite 1233\nRF19539007547034", Invoice{}},
+		{"Extra check digits", "FI21123456000007851\nViite 12322\nRF185390075470345", Invoice{}},
+		{"Following words", "FI21 1234 5600 0007 85 NDEAFIHH\nViite 1232 31.10.2026",
+			Invoice{IBAN: "FI2112345600000785", Reference: "1232"}},
+		{"Not a bill", "Kirje 17.10.2026 yhteensä kolme sivua", Invoice{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExtractInvoice(tt.text)
+			compare(t, "ExtractInvoice() not expected", tt.want, got)
+		})
+	}
+}
+
+func Test_setInvoice(t *testing.T) {
+	img := Image{Invoice: Invoice{IBAN: "old", Amount: 10, Paid: true}}
+	err := setInvoice(&img, map[string]string{
+		"reference": "1232",
+		"duedate":   "2026-10-31",
+		"amount":    "500",
+	})
+	if err != nil {
+		t.Fatalf("setInvoice() error = %v", err)
+	}
+	want := Invoice{
+		Reference: "1232",
+		DueDate:   time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC),
+		Amount:    500,
+		Paid:      true,
+	}
+	compare(t, "setInvoice() not expected", want, img.Invoice)
+
+	err = setInvoice(&img, map[string]string{"amount": "lots"})
+	if err == nil {
+		t.Errorf("setInvoice() should fail with an invalid amount")
+	}
+}
+
+func Test_setInvoice_explicitDueDate(t *testing.T) {
+	explicit := time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC)
+	img := Image{DueSource: DateSourceExplicit, Invoice: Invoice{DueDate: explicit}}
+	err := setInvoice(&img, map[string]string{"duedate": "2026-10-31", "amount": "500"})
+	if err != nil {
+		t.Fatalf("setInvoice() error = %v", err)
+	}
+	if !img.DueDate.Equal(explicit) || img.Amount != 500 || img.DueSource != DateSourceExplicit {
+		t.Errorf("setInvoice() should keep the explicit due date: %+v", img)
+	}
+}
@@ -0,0 +1,182 @@
+package paperless
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	util "github.com/kopoli/go-util"
+)
+
+// The Code 39 patterns of the characters of the archive serial numbers. The
+// elements alternate between bars and spaces starting with a bar and three
+// of the nine are wide.
+var code39Patterns = map[rune]string{
+	'0': "nnnwwnwnn", '1': "wnnwnnnnw", '2': "nnwwnnnnw", '3': "wnwwnnnnn",
+	'4': "nnnwwnnnw", '5': "wnnwwnnnn", '6': "nnwwwnnnn", '7': "nnnwnnwnw",
+	'8': "wnnwnnwnn", '9': "nnwwnnwnn", 'A': "wnnnnwnnw", 'N': "nnnnwnnww",
+	'S': "nnwnnnwwn", '*': "nwnnwnwnn",
+}
+
+// The 5x7 glyphs of the characters printed under the barcode
+var labelGlyphs = map[rune][7]string{
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+}
+
+const (
+	// The resolution of the sheets
+	labelDPI = 300
+
+	// The size of an A4 sheet at 300 dpi
+	labelSheetWidth  = 2480
+	labelSheetHeight = 3508
+
+	// The sheet has 3x8 labels of 70x37 mm
+	labelColumns = 3
+	labelRows    = 8
+	labelWidth   = labelSheetWidth / labelColumns
+	labelHeight  = labelSheetHeight / labelRows
+
+	// MaxLabels is the number of labels on a sheet
+	MaxLabels = labelColumns * labelRows
+
+	// MaxLabelSheets is the number of sheets printed at once
+	MaxLabelSheets = 10
+
+	// The widths of the narrow and wide elements and the height of the
+	// barcode in pixels
+	code39Narrow = 3
+	code39Wide   = 8
+	code39Height = 200
+
+	// The scale of the glyphs
+	glyphScale = 6
+)
+
+// ASNLabel returns the text of the label of the archive serial number. It
+// matches the default --asn-pattern.
+func ASNLabel(asn int) string {
+	return fmt.Sprintf("ASN%05d", asn)
+}
+
+// code39 returns the widths of the bars and spaces of the text with the
+// start and stop characters. Every other width is a bar starting from the
+// first one. The characters are separated with a narrow space.
+func code39(text string) (ret []int, err error) {
+	for i, r := range "*" + text + "*" {
+		pattern, ok := code39Patterns[r]
+		if !ok || (r == '*' && i != 0 && i != len(text)+1) {
+			return nil, util.E.New("Character %q can not be encoded", r)
+		}
+		if i > 0 {
+			ret = append(ret, code39Narrow)
+		}
+		for _, e := range pattern {
+			if e == 'w' {
+				ret = append(ret, code39Wide)
+			} else {
+				ret = append(ret, code39Narrow)
+			}
+		}
+	}
+	return
+}
+
+// drawLabel draws the barcode and the text centered to the rectangle
+func drawLabel(img *image.Gray, rect image.Rectangle, text string) error {
+	widths, err := code39(text)
+	if err != nil {
+		return err
+	}
+	width := 0
+	for _, w := range widths {
+		width += w
+	}
+
+	textWidth := len(text)*6*glyphScale - glyphScale
+	height := code39Height + 4*glyphScale + 7*glyphScale
+	if width > rect.Dx() || textWidth > rect.Dx() || height > rect.Dy() {
+		return util.E.New("The label %s does not fit", text)
+	}
+
+	black := image.NewUniform(color.Black)
+	x := rect.Min.X + (rect.Dx()-width)/2
+	y := rect.Min.Y + (rect.Dy()-height)/2
+	for i, w := range widths {
+		if i%2 == 0 {
+			draw.Draw(img, image.Rect(x, y, x+w, y+code39Height), black, image.ZP, draw.Src)
+		}
+		x += w
+	}
+
+	x = rect.Min.X + (rect.Dx()-textWidth)/2
+	y += code39Height + 4*glyphScale
+	for _, r := range text {
+		glyph := labelGlyphs[r]
+		for row := range glyph {
+			for col, c := range glyph[row] {
+				if c != '#' {
+					continue
+				}
+				px := x + col*glyphScale
+				py := y + row*glyphScale
+				draw.Draw(img, image.Rect(px, py, px+glyphScale, py+glyphScale),
+					black, image.ZP, draw.Src)
+			}
+		}
+		x += 6 * glyphScale
+	}
+	return nil
+}
+
+// LabelsPDF creates a PDF document of the A4 sheets of the labels of the
+// count archive serial numbers starting from start. Each sheet has at most
+// MaxLabels labels and the document at most MaxLabelSheets sheets.
+func LabelsPDF(start, count int) ([]byte, error) {
+	if count <= 0 || count > MaxLabelSheets*MaxLabels {
+		return nil, util.E.New("Invalid label count %d, the maximum is %d",
+			count, MaxLabelSheets*MaxLabels)
+	}
+
+	sheets := (count + MaxLabels - 1) / MaxLabels
+	return grayPDF(sheets, func(i int) (*image.Gray, error) {
+		n := count - i*MaxLabels
+		if n > MaxLabels {
+			n = MaxLabels
+		}
+		return LabelSheet(start+i*MaxLabels, n)
+	}, labelDPI)
+}
+
+// LabelSheet draws an A4 sheet of labels of the count archive serial
+// numbers starting from start. The labels are printed at 300 dpi.
+func LabelSheet(start, count int) (*image.Gray, error) {
+	if start <= 0 || count <= 0 || count > MaxLabels {
+		return nil, util.E.New("Invalid labels: start %d, count %d", start, count)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, labelSheetWidth, labelSheetHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	for i := 0; i < count; i++ {
+		x := (i % labelColumns) * labelWidth
+		y := (i / labelColumns) * labelHeight
+		err := drawLabel(img, image.Rect(x, y, x+labelWidth, y+labelHeight), ASNLabel(start+i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,175 @@
+package paperless
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func Test_code39(t *testing.T) {
+	widths, err := code39("ASN00042")
+	if err != nil {
+		t.Fatalf("code39() error = %v", err)
+	}
+
+	// 10 characters of 9 elements separated with 9 spaces
+	if len(widths) != 10*9+9 {
+		t.Fatalf("code39() got %d elements", len(widths))
+	}
+	if len(widths)%2 != 1 {
+		t.Errorf("code39() should start and end with a bar")
+	}
+	wide := 0
+	for _, w := range widths {
+		if w == code39Wide {
+			wide++
+		}
+	}
+	if wide != 10*3 {
+		t.Errorf("code39() got %d wide elements, want %d", wide, 10*3)
+	}
+
+	for _, text := range []string{"asn1", "ASN-1", "A*1"} {
+		if _, err := code39(text); err == nil {
+			t.Errorf("code39(%q) should fail", text)
+		}
+	}
+}
+
+func TestLabelSheet(t *testing.T) {
+	sheet, err := LabelSheet(99998, MaxLabels)
+	if err != nil {
+		t.Fatalf("LabelSheet() error = %v", err)
+	}
+	if sheet.Bounds() != image.Rect(0, 0, labelSheetWidth, labelSheetHeight) {
+		t.Errorf("LabelSheet() got size %v", sheet.Bounds())
+	}
+
+	// Each label has ink at its center row of the barcode
+	for i := 0; i < MaxLabels; i++ {
+		x := (i % labelColumns) * labelWidth
+		y := (i/labelColumns)*labelHeight + labelHeight/2 - 50
+		dark := false
+		for px := x; px < x+labelWidth; px++ {
+			if sheet.GrayAt(px, y).Y == 0 {
+				dark = true
+				break
+			}
+		}
+		if !dark {
+			t.Errorf("Label %d is empty", i)
+		}
+	}
+
+	for _, c := range [][2]int{{0, 1}, {1, 0}, {1, MaxLabels + 1}} {
+		if _, err := LabelSheet(c[0], c[1]); err == nil {
+			t.Errorf("LabelSheet(%d, %d) should fail", c[0], c[1])
+		}
+	}
+}
+
+func TestLabelsPDF(t *testing.T) {
+	pdf, err := LabelsPDF(1, MaxLabels+1)
+	if err != nil {
+		t.Fatalf("LabelsPDF() error = %v", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Errorf("LabelsPDF() is not a PDF document")
+	}
+	if !bytes.Contains(pdf, []byte("/Count 2 ")) ||
+		bytes.Count(pdf, []byte("/Subtype /Image")) != 2 {
+		t.Errorf("LabelsPDF() should have two pages")
+	}
+
+	for _, count := range []int{0, MaxLabelSheets*MaxLabels + 1} {
+		if _, err := LabelsPDF(1, count); err == nil {
+			t.Errorf("LabelsPDF() of %d labels should fail", count)
+		}
+	}
+
+	// The cross-reference table points to the objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatalf("LabelsPDF() has no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("LabelsPDF() startxref %d does not point to the table", xref)
+	}
+	for i, off := range regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(pdf[xref:], -1) {
+		pos, _ := strconv.Atoi(string(off[1]))
+		if !bytes.HasPrefix(pdf[pos:], []byte(strconv.Itoa(i+1)+" 0 obj\n")) {
+			t.Errorf("LabelsPDF() object %d is not at offset %d", i+1, pos)
+		}
+	}
+}
+
+func Test_db_ASN(t *testing.T) {
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	next, err := db.nextASN()
+	if err != nil || next != 1 {
+		t.Fatalf("nextASN() = %d, %v, want 1", next, err)
+	}
+
+	var images []Image
+	for _, sum := range []string{"a", "b", "c"} {
+		img, err := db.addImage(Image{Checksum: sum})
+		if err != nil {
+			t.Fatalf("Adding an image failed: %v", err)
+		}
+		images = append(images, img)
+	}
+
+	images[0].ASN = 10
+	err = db.updateImage(images[0])
+	if err != nil {
+		t.Fatalf("Setting the ASN failed: %v", err)
+	}
+
+	err = db.assignASN(&images[1])
+	if err != nil || images[1].ASN != 11 {
+		t.Errorf("assignASN() = %d, %v, want 11", images[1].ASN, err)
+	}
+
+	images[2].ASN = 10
+	err = db.updateImage(images[2])
+	if err == nil {
+		t.Errorf("A duplicate ASN should fail")
+	}
+
+	img, err := db.getImageByASN(11)
+	if err != nil || img.Id != images[1].Id {
+		t.Errorf("getImageByASN() = %d, %v, want %d", img.Id, err, images[1].Id)
+	}
+	_, err = db.getImageByASN(12)
+	if err != sql.ErrNoRows {
+		t.Errorf("getImageByASN() of a missing number error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	next, err = db.nextASN()
+	if err != nil || next != 12 {
+		t.Errorf("nextASN() = %d, %v, want 12", next, err)
+	}
+
+	// The numbers of the printed labels are not assigned
+	start, err := db.reserveASNs(5)
+	if err != nil || start != 12 {
+		t.Errorf("reserveASNs() = %d, %v, want 12", start, err)
+	}
+	next, err = db.nextASN()
+	if err != nil || next != 17 {
+		t.Errorf("nextASN() after the reservation = %d, %v, want 17", next, err)
+	}
+	err = db.assignASN(&images[2])
+	if err != nil || images[2].ASN != 17 {
+		t.Errorf("assignASN() after the reservation = %d, %v, want 17", images[2].ASN, err)
+	}
+}
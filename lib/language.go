@@ -0,0 +1,95 @@
+package paperless
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Language is a language the OCR text can be identified as
+type Language struct {
+	// Code is the ISO 639-1 code, e.g. "sv"
+	Code string
+
+	// Traineddata is the name of the tesseract language data, e.g. "swe"
+	Traineddata string
+
+	// The most common words of the language
+	words map[string]bool
+}
+
+var languages = map[string]*Language{}
+
+// RegisterLanguage adds a language to the detection. The words are the most
+// common words of the language in lower case.
+func RegisterLanguage(code, traineddata string, words []string) {
+	l := &Language{Code: code, Traineddata: traineddata, words: map[string]bool{}}
+	for _, w := range words {
+		l.words[w] = true
+	}
+	languages[code] = l
+}
+
+func init() {
+	RegisterLanguage("fi", "fin", strings.Fields(`
+		ja on ei se että oli ovat olla kun mutta tai jos myös sekä
+		hän me te he minä sinä tämä tuo joka mikä kuin niin vain
+		jo nyt sitten kanssa mukaan ennen jälkeen yli alle koska
+		vuonna vuoden vuotta euroa päivä päivänä asti saakka lasku
+		laskun eräpäivä viitenumero summa maksu yhteensä sivu osoite`))
+	RegisterLanguage("sv", "swe", strings.Fields(`
+		och i att det som en på är av för med till den har de inte om
+		ett han men var jag sig från vi så kan man när år säger hon
+		under också efter eller nu sin där vid mot ska skulle kommer
+		ut får finns vara hade alla andra mycket än här då sedan över
+		faktura förfallodag belopp summa datum sida adress`))
+	RegisterLanguage("en", "eng", strings.Fields(`
+		the of and to a in is that for it as was with be by on not he
+		this are or his from at which but have an they you were her
+		she there been one all we their has would when if will more
+		no out so can what up about than into them only other new
+		invoice due date amount total page address please`))
+}
+
+// DetectLanguage identifies the language of the text from its common
+// words. Returns the language with the largest share of the words or nil if
+// too few words are recognized.
+func DetectLanguage(text string) (ret *Language, score float64) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) == 0 {
+		return nil, 0
+	}
+
+	hits := map[string]int{}
+	for _, w := range words {
+		for code, l := range languages {
+			if l.words[w] {
+				hits[code]++
+			}
+		}
+	}
+
+	// The languages are ordered for a stable result on ties
+	var codes []string
+	for code := range languages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	best := 0
+	for _, code := range codes {
+		if hits[code] > best {
+			best = hits[code]
+			ret = languages[code]
+		}
+	}
+
+	// A few short words are common to many languages
+	const minHits = 3
+	if best < minHits {
+		return nil, 0
+	}
+	return ret, float64(best) / float64(len(words))
+}
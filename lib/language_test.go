@@ -0,0 +1,29 @@
+package paperless
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"Finnish", "Lasku on maksettava ennen eräpäivää. Jos summa on jo maksettu, tämä viesti ei koske teitä.", "fi"},
+		{"Swedish", "Fakturan ska betalas före förfallodagen. Om den redan är betald, kan du bortse från detta.", "sv"},
+		{"English", "The invoice is due on the date below. If you have already paid the amount, please ignore this.", "en"},
+		{"Too few words", "Lorem ipsum dolor sit amet", ""},
+		{"Empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := DetectLanguage(tt.text)
+			code := ""
+			if got != nil {
+				code = got.Code
+			}
+			if code != tt.want {
+				t.Errorf("DetectLanguage() = %q, want %q", code, tt.want)
+			}
+		})
+	}
+}
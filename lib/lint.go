@@ -0,0 +1,255 @@
+package paperless
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Diagnostic is a problem found in a script
+type Diagnostic struct {
+	// Line and Column are 1-based. The column counts characters.
+	Line   int
+	Column int
+
+	// Severity is either "error" or "warning". A script with errors cannot
+	// be run.
+	Severity string
+	Message  string
+}
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// LintScript checks the script and returns all the problems found in it
+// ordered by position. The constants of the environment are the ones given
+// before running the script. The commands are checked against the
+// AllowedCommands and the Policy of the environment if they are set.
+func LintScript(script string, e *Environment) (ret []Diagnostic) {
+	ret = []Diagnostic{}
+
+	report := func(line int, text string, offset int, severity, format string, a ...interface{}) {
+		ret = append(ret, Diagnostic{
+			Line:     line,
+			Column:   utf8.RuneCountInString(text[:offset]) + 1,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, a...),
+		})
+	}
+
+	defined := map[string]bool{}
+	for name := range e.Constants {
+		defined[name] = true
+	}
+
+	// The first reference and the reference count of each temporary file
+	type tmpUse struct {
+		line, offset, count int
+		text                string
+	}
+	tmpUses := map[string]*tmpUse{}
+	var tmpOrder []string
+
+	lines := strings.Split(script, "\n")
+	for i, text := range lines {
+		lineno := i + 1
+
+		if m := paramRe.FindStringSubmatch(text); m != nil {
+			if !paramValueRe.MatchString(m[2]) {
+				report(lineno, text, strings.Index(text, m[1]), severityError,
+					"invalid default for parameter %s", m[1])
+			}
+			defined[m[1]] = true
+			continue
+		}
+
+		if loc := commentRe.FindStringIndex(text); loc != nil {
+			text = text[:loc[0]]
+		}
+
+		args, offsets, unclosed := splitWsQuotePos(text)
+		if unclosed >= 0 {
+			report(lineno, text, unclosed, severityError, "unbalanced quote")
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		link, err := parseLink(args)
+		if err != nil {
+			report(lineno, text, offsets[0], severityError, "%s", err)
+			continue
+		}
+
+		// The constants referenced in the arguments
+		capture := ""
+		if c, ok := link.(*Capture); ok {
+			capture = c.Name
+		}
+		for k, a := range args {
+			if k == 0 && capture != "" {
+				continue
+			}
+			for _, loc := range constRe.FindAllStringSubmatchIndex(a, -1) {
+				ref := parseConstRefs(a[loc[0]:loc[1]])
+				if len(ref) == 0 {
+					continue
+				}
+				r := ref[0]
+				offset := offsets[k] + loc[0]
+
+				if tmpfileConstRe.MatchString("$" + r.Name) {
+					if _, ok := tmpUses[r.Name]; !ok {
+						tmpUses[r.Name] = &tmpUse{lineno, offset, 0, text}
+						tmpOrder = append(tmpOrder, r.Name)
+					}
+					tmpUses[r.Name].count++
+					continue
+				}
+				if !defined[r.Name] && !r.HasDefault {
+					report(lineno, text, offset, severityError,
+						"constant \"%s\" not defined", r.Name)
+				}
+			}
+			if strings.Contains(constRe.ReplaceAllString(a, ""), "${") {
+				report(lineno, text, offsets[k]+strings.Index(a, "${"), severityError,
+					"invalid constant reference")
+			}
+		}
+
+		// The commands of the line
+		cursor := 0
+		for _, ex := range linkCommands(link) {
+			cmd := ex.Cmd
+			k := cursor
+			for ; k < len(args); k++ {
+				if strings.TrimLeft(args[k], "-") == cmd[0] {
+					break
+				}
+			}
+			if k == len(args) {
+				k = 0
+			}
+			cursor = k + len(cmd)
+			at := func(idx int) int {
+				if k+idx >= len(offsets) {
+					return offsets[len(offsets)-1]
+				}
+				if idx == 0 {
+					return offsets[k] + len(args[k]) - len(cmd[0])
+				}
+				return offsets[k+idx]
+			}
+
+			lintCommand(cmd, capture != "", e, func(idx int, severity, format string, a ...interface{}) {
+				report(lineno, text, at(idx), severity, format, a...)
+			})
+		}
+
+		if capture != "" {
+			if tmpfileConstRe.MatchString("$" + capture) {
+				report(lineno, text, offsets[0], severityError,
+					"cannot capture to a temporary file constant $%s", capture)
+			}
+			defined[capture] = true
+		}
+	}
+
+	for _, name := range tmpOrder {
+		u := tmpUses[name]
+		if u.count < 2 {
+			report(u.line, u.text, u.offset, severityWarning,
+				"temporary file $%s is used only once", name)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Line != ret[j].Line {
+			return ret[i].Line < ret[j].Line
+		}
+		return ret[i].Column < ret[j].Column
+	})
+	return
+}
+
+// lintCommand checks a single command. The problems are reported with the
+// index of the argument they concern.
+func lintCommand(cmd []string, captured bool, e *Environment,
+	report func(idx int, severity, format string, a ...interface{})) {
+
+	name := cmd[0]
+	if isBuiltin(name) {
+		err := (&Builtin{Cmd{cmd}}).validateCount()
+		if err != nil {
+			report(0, severityError, "%s", err)
+		}
+	} else if _, err := exec.LookPath(name); err != nil {
+		report(0, severityError, "unknown command %s", name)
+	}
+
+	allowed := true
+	if e.AllowedCommands != nil && !e.AllowedCommands[name] {
+		report(0, severityError, "command %s is not allowed", name)
+		allowed = false
+	}
+	if e.Policy != nil && allowed {
+		err := e.Policy.Check(cmd)
+		if pe, ok := err.(*PolicyError); ok {
+			idx := 0
+			for i, a := range cmd {
+				if a == pe.Arg {
+					idx = i
+					break
+				}
+			}
+			report(idx, severityError, "%s", err)
+		} else if err != nil {
+			report(0, severityError, "%s", err)
+		}
+	}
+
+	redirects := 0
+	for idx, a := range cmd {
+		if a != ">" {
+			continue
+		}
+		redirects++
+		switch {
+		case captured:
+			report(idx, severityError, "the output of a captured command cannot be redirected")
+		case redirects > 1:
+			report(idx, severityError, "the output can be redirected only once")
+		case idx == len(cmd)-1 || cmd[idx+1] == "":
+			report(idx, severityError, "the output redirection requires a file")
+		}
+	}
+}
+
+// linkCommands returns the commands of the link in the order they appear in
+// the script
+func linkCommands(l Link) (ret []*Cmd) {
+	switch v := l.(type) {
+	case *Cmd:
+		ret = append(ret, v)
+	case *Builtin:
+		ret = append(ret, &v.Cmd)
+	case *Capture:
+		ret = linkCommands(v.Cmd)
+	case *Optional:
+		ret = linkCommands(v.Link)
+	case *Guard:
+		ret = linkCommands(v.Link)
+	case *Timeout:
+		ret = linkCommands(v.Link)
+	case *Fallback:
+		for _, sub := range v.Links {
+			ret = append(ret, linkCommands(sub)...)
+		}
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package paperless
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintScript(t *testing.T) {
+	policy, err := ParsePolicy("allow echo\nallow cat\nallow @write\ndeny cat /etc/*")
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		policy *Policy
+		want   []Diagnostic
+	}{
+		{"Proper script", "echo $input > $tmpA\ncat $tmpA", nil, []Diagnostic{}},
+		{"Unknown command", "echo a\n  nonexistent-command a", nil, []Diagnostic{
+			{2, 3, severityError, "unknown command nonexistent-command"},
+		}},
+		{"Undefined constants", "echo $a ${b:-x}\n$b = echo $c\necho $b", nil, []Diagnostic{
+			{1, 6, severityError, "constant \"a\" not defined"},
+			{2, 11, severityError, "constant \"c\" not defined"},
+		}},
+		{"Parameter", "# param a=b\necho $a", nil, []Diagnostic{}},
+		{"Unbalanced quote", "echo \"a b", nil, []Diagnostic{
+			{1, 6, severityError, "unbalanced quote"},
+		}},
+		{"Bad redirects", "echo a >\necho a > $tmpA > $tmpA\n$a = echo b > $tmpA", nil, []Diagnostic{
+			{1, 8, severityError, "the output redirection requires a file"},
+			{2, 16, severityError, "the output can be redirected only once"},
+			{3, 13, severityError, "the output of a captured command cannot be redirected"},
+		}},
+		{"Unused temporary file", "echo a > $tmpA", nil, []Diagnostic{
+			{1, 10, severityWarning, "temporary file $tmpA is used only once"},
+		}},
+		{"Disallowed commands", "true || echo a\ncat /etc/passwd\n@write $input", policy, []Diagnostic{
+			{1, 1, severityError, "command true is not allowed"},
+			{2, 5, severityError, "argument \"/etc/passwd\" is denied by the pattern \"/etc/*\""},
+		}},
+		{"Built-in arguments", "-@write", nil, []Diagnostic{
+			{1, 2, severityError, "built-in command @write got 0 arguments"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Environment{Constants: map[string]string{"input": ""}}
+			if tt.policy != nil {
+				e.AllowedCommands = tt.policy.AllowedCommands()
+				e.Policy = tt.policy
+			}
+			got := LintScript(tt.script, &e)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LintScript() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
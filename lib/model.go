@@ -3,7 +3,10 @@ package paperless
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
+
+	util "github.com/kopoli/go-util"
 )
 
 type Image struct {
@@ -17,6 +20,67 @@ type Image struct {
 	ProcessLog    string
 	Filename      string
 
+	// Params are the script parameters given for the image in the form
+	// "name=value,name2=value2"
+	Params string
+
+	// The script and its version that produced the text and the files
+	ScriptName    string
+	ScriptVersion int
+
+	// The detected clockwise rotation in degrees and the writing script of
+	// the page
+	Orientation   int
+	WritingScript string
+
+	// Rotation is the clockwise rotation in degrees that was given by
+	// hand. It is applied to the original before processing.
+	Rotation int
+
+	// The mean and minimum confidence of the recognized words from 0 to
+	// 100. They are 0 if the script did not report them.
+	Confidence    float64
+	MinConfidence float64
+
+	// DocumentDate is the date of the document and DateSource tells where
+	// it is from: the upload, the text or the EXIF data of the original
+	DocumentDate time.Time
+	DateSource   string
+
+	// The payment details if the image is a bill
+	Invoice
+
+	// DueSource tells if the DueDate was given explicitly or found from
+	// the text. RemindDays is how many days before the DueDate it is
+	// reminded of.
+	DueSource  string
+	RemindDays int
+
+	// Barcodes are the decoded barcodes and QR codes one per line
+	Barcodes string
+
+	// ASN is the archive serial number of the paper original or 0
+	ASN int
+
+	// Document is the id of the first page of the batch document the image
+	// belongs to or 0 if the image was uploaded alone
+	Document int
+
+	// PHash is the perceptual hash of the clean image in hex. It is empty
+	// if the image could not be decoded.
+	PHash string
+
+	// Warnings are the problems found when the image was uploaded one per
+	// line. They are sent as a list in the REST responses.
+	Warnings string `json:"-"`
+
+	// Language is the ISO 639-1 code of the detected language of the text
+	Language string
+
+	// NeedsReview is set if the text is empty or its confidence is low.
+	// It is cleared when the image is marked as reviewed.
+	NeedsReview bool
+
 	// in imgtext
 	Text    string
 	Comment string
@@ -30,6 +94,14 @@ func (i *Image) imgFile(basedir, kind, extension string) string {
 		fmt.Sprintf("%05d-%s.%s", i.Id, kind, extension)))
 	return ret
 }
+// WarningList returns the warnings of the image as a list
+func (i *Image) WarningList() []string {
+	if i.Warnings == "" {
+		return []string{}
+	}
+	return strings.Split(i.Warnings, "\n")
+}
+
 func (i *Image) OrigFile(basedir string) string {
 	return i.imgFile(basedir, "original", i.Fileid)
 }
@@ -50,10 +122,45 @@ type Tag struct {
 	Id      int
 	Name    string
 	Comment string
+
+	// Params are the default script parameters for the images with the
+	// tag in the form "name=value,name2=value2"
+	Params string
 }
 
 type Script struct {
 	Id     int
 	Name   string
 	Script string
+
+	// Version is the number of the current version
+	Version int
+}
+
+// ScriptVersion is a stored version of a script
+type ScriptVersion struct {
+	Id       int
+	ScriptId int
+	Version  int
+	Script   string
+	Author   string
+	Message  string
+	Date     time.Time
+}
+
+// ParseParams parses script parameters of the form "name=value,name2=value2"
+func ParseParams(s string) (ret map[string]string, err error) {
+	ret = map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, util.E.New("Invalid script parameter: %s", p)
+		}
+		ret[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return
 }
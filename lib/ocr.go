@@ -0,0 +1,320 @@
+package paperless
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	util "github.com/kopoli/go-util"
+)
+
+// OCRWord is a recognized word and its bounding box in pixels
+type OCRWord struct {
+	Text                string
+	Left, Top           int
+	Width, Height       int
+	Confidence          float64
+	Block, Par, LineNum int
+}
+
+// OCRResult is the outcome of recognizing a page
+type OCRResult struct {
+	Text  string
+	Words []OCRWord
+
+	// Confidence is the mean confidence of the words from 0 to 100
+	Confidence float64
+}
+
+// OCROptions are given to an OCREngine
+type OCROptions struct {
+	// Settings of the engine, e.g. "lang"
+	Settings map[string]string
+
+	// Command creates a command for running an external program. It
+	// applies the sandbox of the processing.
+	Command func(args ...string) (*exec.Cmd, error)
+}
+
+// OCREngine recognizes the text of a page image
+type OCREngine interface {
+	Recognize(page string, opts OCROptions) (OCRResult, error)
+}
+
+var ocrEngines = map[string]OCREngine{}
+
+// RegisterOCREngine registers an engine that is selected in the scripts with
+// the setting engine=name of the @ocr command
+func RegisterOCREngine(name string, e OCREngine) {
+	ocrEngines[name] = e
+}
+
+// OCREngines returns the names of the registered engines
+func OCREngines() (ret []string) {
+	for name := range ocrEngines {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return
+}
+
+func init() {
+	RegisterOCREngine("tesseract", TesseractEngine{})
+	RegisterBuiltin("ocr", 2, -1, builtinOCR)
+}
+
+// ocrEngineArgs selects the engine and its options from the NAME=VALUE
+// arguments of a built-in command. The engine is selected with engine=NAME.
+func ocrEngineArgs(s *Status, args []string) (name string, engine OCREngine, opts OCROptions, err error) {
+	settings := map[string]string{}
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			err = util.E.New("Invalid OCR setting: %s", a)
+			return
+		}
+		settings[kv[0]] = kv[1]
+	}
+
+	name = settings["engine"]
+	if name == "" {
+		name = "tesseract"
+	}
+	delete(settings, "engine")
+	engine, ok := ocrEngines[name]
+	if !ok {
+		err = util.E.New("OCR engine \"%s\" not found", name)
+		return
+	}
+
+	opts = OCROptions{
+		Settings: settings,
+		Command:  commandFunc(s),
+	}
+	return
+}
+
+// commandFunc returns a function that creates the commands of the built-in
+// commands. The commands are run in the sandbox of the processing and they
+// can read the files of the arguments that the built-in command could. They
+// are killed when the timeout of the link expires.
+func commandFunc(s *Status) func(args ...string) (*exec.Cmd, error) {
+	return func(args ...string) (cmd *exec.Cmd, err error) {
+		if s.Sandbox != nil {
+			var readable []string
+			for _, a := range args[1:] {
+				if path, e2 := s.filePath(a, false); e2 == nil && filepath.IsAbs(a) {
+					readable = append(readable, path)
+				}
+			}
+			return s.Sandbox.command(s.runContext(), s.RootDir, readable, nil, args)
+		}
+		cmd = exec.CommandContext(s.runContext(), args[0], args[1:]...)
+		cmd.Dir = s.RootDir
+		return
+	}
+}
+
+// @ocr [NAME=VALUE...] IMAGE TEXTFILE recognizes the text of IMAGE and writes
+// it to TEXTFILE. The engine is selected with engine=NAME and the rest of
+// the settings are given to the engine. The mean and minimum confidence of
+// the words are reported as the results "confidence" and "minconfidence".
+//
+// The language of the text is detected and reported as the result
+// "language". If the setting languages=LANG1,LANG2... is given, the text is
+// recognized again with the detected one of these languages when it differs
+// from the lang setting.
+func builtinOCR(s *Status, args []string, stdout io.Writer) error {
+	page, err := s.filePath(args[len(args)-2], false)
+	if err != nil {
+		return err
+	}
+	textfile, err := s.filePath(args[len(args)-1], true)
+	if err != nil {
+		return err
+	}
+
+	name, engine, opts, err := ocrEngineArgs(s, args[:len(args)-2])
+	if err != nil {
+		return err
+	}
+	var candidates []string
+	if v := opts.Settings["languages"]; v != "" {
+		candidates = strings.Split(v, ",")
+	}
+	delete(opts.Settings, "languages")
+
+	res, err := engine.Recognize(page, opts)
+	if err != nil {
+		return util.E.Annotate(err, "OCR engine ", name, " failed")
+	}
+
+	lang, score := DetectLanguage(res.Text)
+	if lang != nil {
+		if s.Log != nil {
+			fmt.Fprintf(s.Log, "# Detected language %s with score %.2f\n", lang.Code, score)
+		}
+		if lang.Traineddata != opts.Settings["lang"] && hasString(candidates, lang.Traineddata) {
+			if s.Log != nil {
+				fmt.Fprintln(s.Log, "# Recognizing again with the language", lang.Traineddata)
+			}
+			opts.Settings["lang"] = lang.Traineddata
+			res, err = engine.Recognize(page, opts)
+			if err != nil {
+				return util.E.Annotate(err, "OCR engine ", name, " failed")
+			}
+		}
+		s.SetResult("language", lang.Code)
+	}
+
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "# OCR engine %s: %d words with confidence %.1f\n",
+			name, len(res.Words), res.Confidence)
+	}
+	if len(res.Words) > 0 {
+		min := res.Words[0].Confidence
+		for _, w := range res.Words[1:] {
+			if w.Confidence < min {
+				min = w.Confidence
+			}
+		}
+		s.SetResult("confidence", strconv.FormatFloat(res.Confidence, 'f', -1, 64))
+		s.SetResult("minconfidence", strconv.FormatFloat(min, 'f', -1, 64))
+	}
+	return ioutil.WriteFile(textfile, []byte(res.Text), 0644)
+}
+
+// TesseractEngine runs the tesseract command. The settings "lang" and "psm"
+// are given as the corresponding command line options.
+type TesseractEngine struct{}
+
+func (t TesseractEngine) Recognize(page string, opts OCROptions) (ret OCRResult, err error) {
+	args := []string{"tesseract", page, "stdout"}
+	for _, name := range []string{"lang", "psm"} {
+		v, ok := opts.Settings[name]
+		if !ok || v == "" {
+			continue
+		}
+		if name == "lang" {
+			args = append(args, "-l", v)
+		} else {
+			args = append(args, "--"+name, v)
+		}
+	}
+	args = append(args, "tsv")
+
+	cmd, err := opts.Command(args...)
+	if err != nil {
+		return
+	}
+	out := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		err = util.E.Annotate(err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	return parseTesseractTSV(out.String())
+}
+
+// parseTesseractTSV parses the TSV output of tesseract. The lines are
+// separated with newlines and the paragraphs with empty lines.
+func parseTesseractTSV(tsv string) (ret OCRResult, err error) {
+	for i, line := range strings.Split(tsv, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if i == 0 || len(fields) < 12 || fields[0] != "5" {
+			continue
+		}
+
+		var nums [9]int
+		for k := range nums {
+			nums[k], err = strconv.Atoi(fields[k+1])
+			if err != nil {
+				err = util.E.Annotate(err, "Invalid tesseract output on line ", i+1)
+				return
+			}
+		}
+		var conf float64
+		conf, err = strconv.ParseFloat(fields[10], 64)
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid tesseract output on line ", i+1)
+			return
+		}
+
+		text := strings.Join(fields[11:], "\t")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		ret.Words = append(ret.Words, OCRWord{
+			Text:       text,
+			Left:       nums[5],
+			Top:        nums[6],
+			Width:      nums[7],
+			Height:     nums[8],
+			Confidence: conf,
+			Block:      nums[1],
+			Par:        nums[2],
+			LineNum:    nums[3],
+		})
+	}
+
+	ret.Text, ret.Confidence = wordsText(ret.Words)
+	return
+}
+
+// wordsText joins the words to text and calculates their mean confidence
+func wordsText(words []OCRWord) (text string, confidence float64) {
+	buf := &bytes.Buffer{}
+	for i, w := range words {
+		if i > 0 {
+			prev := words[i-1]
+			switch {
+			case prev.Block != w.Block || prev.Par != w.Par:
+				buf.WriteString("\n\n")
+			case prev.LineNum != w.LineNum:
+				buf.WriteString("\n")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString(w.Text)
+		confidence += w.Confidence
+	}
+	if len(words) > 0 {
+		buf.WriteString("\n")
+		confidence /= float64(len(words))
+	}
+	return buf.String(), confidence
+}
+
+// FakeOCREngine returns the words of Text with the given Confidence and the
+// given Orientation. It is meant for testing the processing without an OCR
+// program.
+type FakeOCREngine struct {
+	Text        string
+	Confidence  float64
+	Orientation Orientation
+}
+
+func (f FakeOCREngine) Recognize(page string, opts OCROptions) (ret OCRResult, err error) {
+	for l, line := range strings.Split(f.Text, "\n") {
+		for _, word := range strings.Fields(line) {
+			ret.Words = append(ret.Words, OCRWord{
+				Text:       word,
+				Confidence: f.Confidence,
+				LineNum:    l,
+			})
+		}
+	}
+	ret.Text, ret.Confidence = wordsText(ret.Words)
+	return
+}
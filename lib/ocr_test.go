@@ -0,0 +1,152 @@
+package paperless
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseTesseractTSV(t *testing.T) {
+	tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+		"1\t1\t0\t0\t0\t0\t0\t0\t100\t100\t-1\t\n" +
+		"5\t1\t1\t1\t1\t1\t10\t20\t30\t40\t90\tFirst\n" +
+		"5\t1\t1\t1\t1\t2\t50\t20\t30\t40\t80.5\tline\n" +
+		"5\t1\t1\t1\t2\t1\t10\t70\t30\t40\t70\tsecond\n" +
+		"5\t1\t2\t1\t1\t1\t10\t120\t30\t40\t60\tpara\n" +
+		"5\t1\t2\t1\t1\t2\t10\t120\t30\t40\t-1\t \n"
+
+	res, err := parseTesseractTSV(tsv)
+	if err != nil {
+		t.Fatalf("parseTesseractTSV() error = %v", err)
+	}
+	if want := "First line\nsecond\n\npara\n"; res.Text != want {
+		t.Errorf("parseTesseractTSV() text = %q, want %q", res.Text, want)
+	}
+	if len(res.Words) != 4 {
+		t.Fatalf("parseTesseractTSV() returned %d words, want 4", len(res.Words))
+	}
+	w := res.Words[1]
+	if w.Left != 50 || w.Top != 20 || w.Width != 30 || w.Height != 40 || w.Confidence != 80.5 {
+		t.Errorf("parseTesseractTSV() word = %+v", w)
+	}
+	if res.Confidence != 75.125 {
+		t.Errorf("parseTesseractTSV() confidence = %v, want 75.125", res.Confidence)
+	}
+
+	_, err = parseTesseractTSV("header\n5\t1\tx\t1\t1\t1\t1\t1\t1\t1\t1\tword\n")
+	if err == nil {
+		t.Errorf("parseTesseractTSV() should fail with invalid numbers")
+	}
+}
+
+func Test_builtinOCR(t *testing.T) {
+	RegisterOCREngine("fake", FakeOCREngine{Text: "fake  text\nhere", Confidence: 50})
+	defer delete(ocrEngines, "fake")
+
+	dir, err := ioutil.TempDir("", "ocr")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr bool
+	}{
+		{"Fake engine", "@ocr engine=fake lang=fin $input $output", "fake text\nhere\n", false},
+		{"Unknown engine", "@ocr engine=other $input $output", "", true},
+		{"Invalid setting", "@ocr engine $input $output", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(dir, "output")
+			os.Remove(output)
+
+			ch, err := NewCmdChainScript(tt.script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			buf := &bytes.Buffer{}
+			s := Status{Environment: ch.Environment, Log: buf, Results: &Results{}}
+			s.Constants = map[string]string{"input": filepath.Join(dir, "input"), "output": output}
+			err = RunCmdChain(ch, &s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunCmdChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadFile(output)
+			if string(data) != tt.want {
+				t.Errorf("@ocr wrote %q, want %q", data, tt.want)
+			}
+			if !strings.Contains(buf.String(), "# OCR engine fake: 3 words with confidence 50.0") {
+				t.Errorf("The log does not contain the OCR result: %s", buf.String())
+			}
+			want := map[string]string{"confidence": "50", "minconfidence": "50"}
+			if got := s.Results.Values(); !reflect.DeepEqual(got, want) {
+				t.Errorf("@ocr results = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// languageEngine recognizes Swedish text only with the Swedish language data
+type languageEngine struct{}
+
+func (languageEngine) Recognize(page string, opts OCROptions) (OCRResult, error) {
+	text := "Fakturan ska betalas före förfallodagen och det är bra"
+	if opts.Settings["lang"] != "swe" {
+		text = "Fakt0ran ska beta1as före förfa11odagen och det är bra"
+	}
+	return FakeOCREngine{Text: text, Confidence: 80}.Recognize(page, opts)
+}
+
+func Test_builtinOCR_language(t *testing.T) {
+	RegisterOCREngine("language", languageEngine{})
+	defer delete(ocrEngines, "language")
+
+	dir, err := ioutil.TempDir("", "ocr")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"Recognized again", "lang=fin languages=fin,swe", "Fakturan"},
+		{"Not a candidate", "lang=fin languages=fin,eng", "Fakt0ran"},
+		{"No candidates", "lang=fin", "Fakt0ran"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewCmdChainScript("@ocr engine=language " + tt.args + " $input $output")
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			output := filepath.Join(dir, "output")
+			s := Status{Environment: ch.Environment, Log: &bytes.Buffer{}, Results: &Results{}}
+			s.Constants = map[string]string{"input": filepath.Join(dir, "input"), "output": output}
+			err = RunCmdChain(ch, &s)
+			if err != nil {
+				t.Fatalf("RunCmdChain() error = %v", err)
+			}
+			data, _ := ioutil.ReadFile(output)
+			if !strings.HasPrefix(string(data), tt.want) {
+				t.Errorf("@ocr wrote %q, want it to start with %q", data, tt.want)
+			}
+			if lang := s.Results.Values()["language"]; lang != "sv" {
+				t.Errorf("@ocr language = %q, want %q", lang, "sv")
+			}
+		})
+	}
+}
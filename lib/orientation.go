@@ -0,0 +1,200 @@
+package paperless
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	util "github.com/kopoli/go-util"
+)
+
+// Orientation is the detected orientation of a page
+type Orientation struct {
+	// Rotate is the clockwise rotation in degrees that makes the page
+	// upright: 0, 90, 180 or 270
+	Rotate int
+
+	// Script is the writing script of the page, e.g. "Latin"
+	Script string
+
+	Confidence float64
+}
+
+// OrientationDetector is implemented by the OCREngines that can detect the
+// orientation of a page
+type OrientationDetector interface {
+	DetectOrientation(page string, opts OCROptions) (Orientation, error)
+}
+
+func init() {
+	RegisterBuiltin("orientation", 1, -1, builtinOrientation)
+}
+
+// @orientation [NAME=VALUE...] IMAGE prints the clockwise rotation that makes
+// IMAGE upright. The detected angle and writing script are reported as the
+// results "orientation" and "writingscript". If the orientation cannot be
+// detected, 0 is printed. The engine is selected like in @ocr.
+func builtinOrientation(s *Status, args []string, stdout io.Writer) error {
+	page, err := s.filePath(args[len(args)-1], false)
+	if err != nil {
+		return err
+	}
+	name, engine, opts, err := ocrEngineArgs(s, args[:len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	var o Orientation
+	detector, ok := engine.(OrientationDetector)
+	if ok {
+		o, err = detector.DetectOrientation(page, opts)
+	} else {
+		err = util.E.New("OCR engine %s cannot detect the orientation", name)
+	}
+
+	if err != nil {
+		if s.Log != nil {
+			fmt.Fprintln(s.Log, "# Orientation detection failed:", err)
+		}
+		o = Orientation{}
+	} else {
+		if s.Log != nil {
+			fmt.Fprintf(s.Log, "# Orientation: rotate %d, script %s, confidence %.2f\n",
+				o.Rotate, o.Script, o.Confidence)
+		}
+		s.SetResult("orientation", strconv.Itoa(o.Rotate))
+		s.SetResult("writingscript", o.Script)
+	}
+
+	_, err = fmt.Fprintln(stdout, o.Rotate)
+	return err
+}
+
+func (t TesseractEngine) DetectOrientation(page string, opts OCROptions) (ret Orientation, err error) {
+	cmd, err := opts.Command("tesseract", page, "stdout", "--psm", "0")
+	if err != nil {
+		return
+	}
+	out := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		err = util.E.Annotate(err, strings.TrimSpace(stderr.String()))
+		return
+	}
+
+	return parseTesseractOSD(out.String())
+}
+
+// parseTesseractOSD parses the orientation and script detection output of
+// tesseract
+func parseTesseractOSD(osd string) (ret Orientation, err error) {
+	found := false
+	for _, line := range strings.Split(osd, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+
+		switch strings.TrimSpace(kv[0]) {
+		case "Rotate":
+			ret.Rotate, err = strconv.Atoi(value)
+			found = true
+		case "Orientation confidence":
+			ret.Confidence, err = strconv.ParseFloat(value, 64)
+		case "Script":
+			ret.Script = value
+		}
+		if err != nil {
+			return ret, util.E.Annotate(err, "Invalid orientation output")
+		}
+	}
+
+	if !found {
+		return ret, util.E.New("No orientation in the output")
+	}
+	ret.Rotate = ((ret.Rotate % 360) + 360) % 360
+	if ret.Rotate%90 != 0 {
+		return ret, util.E.New("Invalid rotation %d", ret.Rotate)
+	}
+	return
+}
+
+func (f FakeOCREngine) DetectOrientation(page string, opts OCROptions) (Orientation, error) {
+	return f.Orientation, nil
+}
+
+// rotateImage rotates the image clockwise by a multiple of 90 degrees
+func rotateImage(img image.Image, angle int) (image.Image, error) {
+	angle = ((angle % 360) + 360) % 360
+	if angle%90 != 0 {
+		return nil, util.E.New("The rotation must be a multiple of 90 degrees: %d", angle)
+	}
+	if angle == 0 {
+		return img, nil
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if angle != 180 {
+		w, h = h, w
+	}
+
+	ret := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var dx, dy int
+			switch angle {
+			case 90:
+				dx, dy = b.Dy()-1-y, x
+			case 180:
+				dx, dy = b.Dx()-1-x, b.Dy()-1-y
+			case 270:
+				dx, dy = y, b.Dx()-1-x
+			}
+			ret.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return ret, nil
+}
+
+// RotateImage adds a clockwise rotation of angle degrees to the manual
+// rotation of the image. The original is not modified. The rotation is
+// applied to the copy of the original the processing script reads.
+func RotateImage(img *Image, angle int) error {
+	angle = ((angle % 360) + 360) % 360
+	if angle%90 != 0 {
+		return util.E.New("The rotation must be a multiple of 90 degrees: %d", angle)
+	}
+	img.Rotation = (img.Rotation + angle) % 360
+	return nil
+}
+
+// rotatedOriginal writes the original image of img rotated by its manual
+// rotation as a PNG file to destdir and returns the path of the file
+func rotatedOriginal(img *Image, destdir string) (path string, err error) {
+	orig, err := readImage(img.OrigFile(destdir))
+	if err != nil {
+		return
+	}
+
+	rotated, err := rotateImage(orig, img.Rotation)
+	if err != nil {
+		return
+	}
+
+	path = img.imgFile(destdir, "rotated", "png")
+	err = writeImage(path, rotated)
+	if err != nil {
+		os.Remove(path)
+		err = util.E.Annotate(err, "Writing the rotated image failed")
+	}
+	return
+}
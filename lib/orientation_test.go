@@ -0,0 +1,203 @@
+package paperless
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseTesseractOSD(t *testing.T) {
+	tests := []struct {
+		name    string
+		osd     string
+		want    Orientation
+		wantErr bool
+	}{
+		{"Upside down",
+			"Page number: 0\nOrientation in degrees: 180\nRotate: 180\nOrientation confidence: 12.5\nScript: Latin\nScript confidence: 3.1\n",
+			Orientation{180, "Latin", 12.5}, false},
+		{"Upright", "Rotate: 0\nScript: Cyrillic\n", Orientation{0, "Cyrillic", 0}, false},
+		{"No rotation", "Script: Latin\n", Orientation{Script: "Latin"}, true},
+		{"Invalid rotation", "Rotate: 45\n", Orientation{Rotate: 45}, true},
+		{"Invalid number", "Rotate: x\n", Orientation{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTesseractOSD(tt.osd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTesseractOSD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseTesseractOSD() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rotateImage(t *testing.T) {
+	// A 2x1 image with a black pixel on the left
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.Black)
+	img.Set(1, 0, color.White)
+
+	tests := []struct {
+		angle   int
+		w, h    int
+		blackX  int
+		blackY  int
+		wantErr bool
+	}{
+		{0, 2, 1, 0, 0, false},
+		{90, 1, 2, 0, 0, false},
+		{180, 2, 1, 1, 0, false},
+		{270, 1, 2, 0, 1, false},
+		{-90, 1, 2, 0, 1, false},
+		{45, 0, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := rotateImage(img, tt.angle)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("rotateImage(%d) error = %v, wantErr %v", tt.angle, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		b := got.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("rotateImage(%d) size = %dx%d, want %dx%d", tt.angle, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+		r, _, _, _ := got.At(tt.blackX, tt.blackY).RGBA()
+		if r != 0 {
+			t.Errorf("rotateImage(%d) pixel %d,%d is not black", tt.angle, tt.blackX, tt.blackY)
+		}
+	}
+}
+
+func Test_builtinOrientation(t *testing.T) {
+	RegisterOCREngine("fake", FakeOCREngine{Orientation: Orientation{270, "Latin", 8}})
+	RegisterOCREngine("plain", noOrientationEngine{})
+	defer delete(ocrEngines, "fake")
+	defer delete(ocrEngines, "plain")
+
+	tests := []struct {
+		name        string
+		script      string
+		wantRotate  string
+		wantResults map[string]string
+	}{
+		{"Detected", "$rotate = @orientation engine=fake $input", "270",
+			map[string]string{"orientation": "270", "writingscript": "Latin"}},
+		{"Detection fails", "$rotate = @orientation engine=plain $input", "0",
+			map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewCmdChainScript(tt.script)
+			if err != nil {
+				t.Fatalf("NewCmdChainScript() error = %v", err)
+			}
+			buf := &bytes.Buffer{}
+			s := Status{Environment: ch.Environment, Log: buf, Results: &Results{}}
+			s.Constants = map[string]string{"input": "page.png"}
+			err = RunCmdChain(ch, &s)
+			if err != nil {
+				t.Fatalf("RunCmdChain() error = %v", err)
+			}
+			if s.Constants["rotate"] != tt.wantRotate {
+				t.Errorf("@orientation printed %q, want %q", s.Constants["rotate"], tt.wantRotate)
+			}
+			if got := s.Results.Values(); !reflect.DeepEqual(got, tt.wantResults) {
+				t.Errorf("@orientation results = %v, want %v", got, tt.wantResults)
+			}
+		})
+	}
+}
+
+// noOrientationEngine cannot detect the orientation
+type noOrientationEngine struct{}
+
+func (noOrientationEngine) Recognize(page string, opts OCROptions) (OCRResult, error) {
+	return OCRResult{}, nil
+}
+
+func TestRotateImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotation int
+		angle    int
+		want     int
+		wantErr  bool
+	}{
+		{"Clockwise", 0, 90, 90, false},
+		{"Counterclockwise", 0, -90, 270, false},
+		{"Added", 270, 180, 90, false},
+		{"Not a multiple of 90", 90, 45, 90, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := &Image{Rotation: tt.rotation}
+			err := RotateImage(img, tt.angle)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RotateImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if img.Rotation != tt.want {
+				t.Errorf("RotateImage() rotation = %d, want %d", img.Rotation, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runScriptRotation(t *testing.T) {
+	for _, format := range []string{"png", "jpg", "bmp"} {
+		t.Run(format, func(t *testing.T) {
+			testRunScriptRotation(t, format)
+		})
+	}
+}
+
+func testRunScriptRotation(t *testing.T, format string) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := &Image{Id: 1, Fileid: format, Rotation: 90}
+	err = writeImage(img.OrigFile(dir), image.NewRGBA(image.Rect(0, 0, 3, 2)))
+	if err != nil {
+		t.Fatalf("writeImage() error = %v", err)
+	}
+	orig, err := ioutil.ReadFile(img.OrigFile(dir))
+	if err != nil {
+		t.Fatalf("Reading the original failed: %v", err)
+	}
+
+	_, _, err = runScript(img, "@convert $input $cleanout", "test", &ProcessConfig{}, nil, dir)
+	if err != nil {
+		t.Fatalf("runScript() error = %v", err)
+	}
+	got, err := readImage(img.CleanFile(dir))
+	if err != nil {
+		t.Fatalf("readImage() error = %v", err)
+	}
+	if b := got.Bounds(); b.Dx() != 2 || b.Dy() != 3 {
+		t.Errorf("Processed image size = %dx%d, want 2x3", b.Dx(), b.Dy())
+	}
+
+	data, err := ioutil.ReadFile(img.OrigFile(dir))
+	if err != nil || !bytes.Equal(data, orig) {
+		t.Errorf("The original was modified: %v", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if strings.Contains(f.Name(), "rotated") {
+			t.Errorf("runScript() left the rotated file %s", filepath.Join(dir, f.Name()))
+		}
+	}
+}
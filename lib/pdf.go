@@ -0,0 +1,75 @@
+package paperless
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+)
+
+// grayPDF creates a PDF document of count pages whose images are drawn by
+// the page function one at a time, so only the compressed images are kept
+// in memory. The size of each page is the size of its image at the given
+// resolution.
+func grayPDF(count int, page func(i int) (*image.Gray, error), dpi int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var offsets []int
+	object := func(format string, a ...interface{}) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n", len(offsets))
+		fmt.Fprintf(buf, format, a...)
+		buf.WriteString("\nendobj\n")
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	// The objects of each page are the page, its contents and its image
+	kids := &bytes.Buffer{}
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(kids, "%d 0 R ", 3+3*i)
+	}
+	object("<< /Type /Pages /Kids [ %s] /Count %d >>", kids.String(), count)
+
+	for i := 0; i < count; i++ {
+		img, err := page(i)
+		if err != nil {
+			return nil, err
+		}
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		pw := float64(w) * 72 / float64(dpi)
+		ph := float64(h) * 72 / float64(dpi)
+
+		data := &bytes.Buffer{}
+		zw := zlib.NewWriter(data)
+		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+			off := img.PixOffset(img.Bounds().Min.X, y)
+			_, err := zw.Write(img.Pix[off : off+w])
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		contents := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", pw, ph)
+		object("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+			pw, ph, 5+3*i, 4+3*i)
+		object("<< /Length %d >>\nstream\n%s\nendstream", len(contents), contents)
+		object("<< /Type /XObject /Subtype /Image /Width %d /Height %d "+
+			"/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode "+
+			"/Length %d >>\nstream\n%s\nendstream", w, h, data.Len(), data.Bytes())
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(offsets)+1, xref)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,246 @@
+package paperless
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	util "github.com/kopoli/go-util"
+)
+
+// CommandPolicy restricts the arguments of a command
+type CommandPolicy struct {
+	// Flags are the patterns of the allowed flags, i.e. the arguments
+	// that start with - or +. If this is empty, all flags are allowed.
+	Flags []string
+
+	// Deny are the patterns of the forbidden arguments
+	Deny []string
+
+	// ConstantPaths requires that the paths in the arguments come from
+	// constants
+	ConstantPaths bool
+}
+
+// Policy restricts the commands and their arguments in the scripts. The
+// CommandPolicy of the command "*" applies to all commands.
+type Policy struct {
+	Commands map[string]*CommandPolicy
+}
+
+// DefaultPolicy is the policy of the processing scripts if no other is given
+const DefaultPolicy = `
+# The external commands
+allow convert
+allow unpaper
+allow tesseract
+allow file
+allow cat
+
+# The built-in commands
+allow @copy
+allow @checksum
+allow @write
+allow @convert
+allow @thumbnail
+allow @ocr
+allow @orientation
+allow @invoice
+allow @barcodes
+
+# ImageMagick reads files and scripts given as these arguments
+deny convert @* msl:* mvg:* text:* ephemeral:* -script -write
+
+paths * constants
+`
+
+// ParsePolicy parses the policy from text. Each line has one of the
+// following directives:
+//
+// - "allow COMMAND [FLAG-PATTERN...]" allows the command. If patterns are
+// given, the flags of the command must match one of them.
+//
+// - "deny COMMAND|* PATTERN..." forbids arguments matching the patterns.
+//
+// - "paths COMMAND|* constants" requires that the arguments containing a
+// path separator get the path from a constant. The defaults of the constants
+// are checked as well.
+//
+// In the patterns * matches any string and ? any character. Comments start
+// with # and end with EOL.
+func ParsePolicy(text string) (ret *Policy, err error) {
+	ret = &Policy{Commands: map[string]*CommandPolicy{}}
+
+	get := func(name string) *CommandPolicy {
+		if _, ok := ret.Commands[name]; !ok {
+			ret.Commands[name] = &CommandPolicy{}
+		}
+		return ret.Commands[name]
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		line = commentRe.ReplaceAllString(line, "")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, util.E.New("line %d: directive %s requires a command", i+1, fields[0])
+		}
+
+		switch fields[0] {
+		case "allow":
+			if fields[1] == "*" {
+				return nil, util.E.New("line %d: all commands cannot be allowed", i+1)
+			}
+			cp := get(fields[1])
+			cp.Flags = append(cp.Flags, fields[2:]...)
+		case "deny":
+			if len(fields) < 3 {
+				return nil, util.E.New("line %d: deny requires patterns", i+1)
+			}
+			cp := get(fields[1])
+			cp.Deny = append(cp.Deny, fields[2:]...)
+		case "paths":
+			if len(fields) != 3 || fields[2] != "constants" {
+				return nil, util.E.New("line %d: the syntax is: paths COMMAND constants", i+1)
+			}
+			get(fields[1]).ConstantPaths = true
+		default:
+			return nil, util.E.New("line %d: unknown directive %s", i+1, fields[0])
+		}
+	}
+
+	return
+}
+
+// LoadPolicy reads the policy from a file
+func LoadPolicy(path string) (ret *Policy, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	ret, err = ParsePolicy(string(data))
+	if err != nil {
+		err = util.E.Annotate(err, "Invalid policy file ", path)
+	}
+	return
+}
+
+// AllowedCommands returns the commands the policy allows
+func (p *Policy) AllowedCommands() map[string]bool {
+	ret := map[string]bool{}
+	for name := range p.Commands {
+		if name != "*" {
+			ret[name] = true
+		}
+	}
+	return ret
+}
+
+// PolicyError describes an argument the policy does not allow
+type PolicyError struct {
+	Arg    string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "argument \"" + e.Arg + "\" " + e.Reason
+}
+
+// Check makes sure the arguments of the command are allowed. The arguments
+// are checked before the constants are expanded. The denied patterns and
+// the flags are also checked against the defaults of the constants.
+func (p *Policy) Check(cmd []string) error {
+	return p.check(cmd, false)
+}
+
+// CheckExpanded makes sure the arguments of the command are allowed after
+// the constants are expanded, so the values of the constants, such as the
+// captured outputs of the commands, can not bypass the denied patterns and
+// the flags. The paths are not checked as the constants are expanded to
+// paths.
+func (p *Policy) CheckExpanded(args []string) error {
+	return p.check(args, true)
+}
+
+func (p *Policy) check(cmd []string, expanded bool) error {
+	if len(cmd) == 0 {
+		return nil
+	}
+
+	cp, ok := p.Commands[cmd[0]]
+	if !ok {
+		return util.E.New("command %s is not allowed by the policy", cmd[0])
+	}
+	all := p.Commands["*"]
+	if all == nil {
+		all = &CommandPolicy{}
+	}
+
+	deny := append(append([]string{}, all.Deny...), cp.Deny...)
+	constPaths := all.ConstantPaths || cp.ConstantPaths
+
+	for _, a := range cmd[1:] {
+		if a == ">" {
+			continue
+		}
+
+		err := cp.checkArg(a, a, deny)
+		if err != nil {
+			return err
+		}
+		if expanded {
+			continue
+		}
+
+		// The defaults of the constants are used as such
+		defaults := expandConsts(a, nil)
+		err = cp.checkArg(a, defaults, deny)
+		if err != nil {
+			return err
+		}
+
+		if constPaths && strings.ContainsRune(defaults, '/') {
+			return &PolicyError{a, "has a path that is not from a constant"}
+		}
+	}
+
+	return nil
+}
+
+// checkArg checks the value of the argument against the denied patterns and
+// the allowed flags. Negative numbers are not flags.
+func (cp *CommandPolicy) checkArg(arg, value string, deny []string) error {
+	for _, pat := range deny {
+		if globMatch(pat, value) {
+			return &PolicyError{arg, "is denied by the pattern \"" + pat + "\""}
+		}
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return nil
+	}
+	if len(cp.Flags) > 0 && (strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+")) {
+		matched := false
+		for _, pat := range cp.Flags {
+			matched = matched || globMatch(pat, value)
+		}
+		if !matched {
+			return &PolicyError{arg, "is not an allowed flag"}
+		}
+	}
+	return nil
+}
+
+// globMatch matches s to the pattern where * matches any string and ? any
+// character
+func globMatch(pattern, s string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\*`, `.*`, -1)
+	re = strings.Replace(re, `\?`, `.`, -1)
+	ok, _ := regexp.MatchString("^"+re+"$", s)
+	return ok
+}
@@ -0,0 +1,124 @@
+package paperless
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    *Policy
+		wantErr bool
+	}{
+		{"Empty", "", &Policy{Commands: map[string]*CommandPolicy{}}, false},
+		{"Allowed commands", "allow a\nallow b -x -y*  # comment", &Policy{
+			Commands: map[string]*CommandPolicy{
+				"a": &CommandPolicy{},
+				"b": &CommandPolicy{Flags: []string{"-x", "-y*"}},
+			}}, false},
+		{"Denied arguments", "deny * @*\ndeny a -b", &Policy{
+			Commands: map[string]*CommandPolicy{
+				"*": &CommandPolicy{Deny: []string{"@*"}},
+				"a": &CommandPolicy{Deny: []string{"-b"}},
+			}}, false},
+		{"Paths", "paths * constants", &Policy{
+			Commands: map[string]*CommandPolicy{
+				"*": &CommandPolicy{ConstantPaths: true},
+			}}, false},
+		{"Default policy", DefaultPolicy, nil, false},
+		{"Unknown directive", "permit a", nil, true},
+		{"Allow all", "allow *", nil, true},
+		{"Deny without patterns", "deny a", nil, true},
+		{"Improper paths", "paths a", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePolicy(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	p, err := ParsePolicy(`
+allow convert -depth -normalize -quality
+allow cat
+deny convert @* msl:*
+paths * constants
+`)
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		cmd     []string
+		wantErr bool
+	}{
+		{"Allowed", []string{"convert", "-depth", "8", "$input", "pnm:$tmpA"}, false},
+		{"Not allowed command", []string{"rm", "$input"}, true},
+		{"Not allowed flag", []string{"convert", "-script", "$input"}, true},
+		{"Denied argument", []string{"convert", "@$input", "$output"}, true},
+		{"Denied prefix", []string{"convert", "msl:$input", "$output"}, true},
+		{"Path not from a constant", []string{"cat", "/etc/passwd"}, true},
+		{"Relative path", []string{"cat", "../file"}, true},
+		{"Path from a constant", []string{"cat", "$input", ">", "$output"}, false},
+		{"Denied default", []string{"convert", "${x:-@list}", "$tmpA"}, true},
+		{"Denied prefix in a default", []string{"convert", "${x:-msl:file}", "$tmpA"}, true},
+		{"Not allowed flag in a default", []string{"convert", "${x:--script}", "$tmpA"}, true},
+		{"Negative number", []string{"convert", "-depth", "-8", "$input", "$tmpA"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.Check(tt.cmd); (err != nil) != tt.wantErr {
+				t.Errorf("Policy.Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCmdChain_ValidatePolicy(t *testing.T) {
+	ch, err := NewCmdChainScript("true\n\necho /etc/passwd")
+	if err != nil {
+		t.Fatalf("NewCmdChainScript() error = %v", err)
+	}
+
+	p, _ := ParsePolicy("allow true\nallow echo\npaths * constants")
+	e := ch.Environment
+	e.RootDir = "/"
+	e.Policy = p
+
+	err = ch.Validate(&e)
+	want := `line 3: argument "/etc/passwd" has a path that is not from a constant`
+	if err == nil || err.Error() != want {
+		t.Errorf("CmdChain.Validate() error = %v, want %s", err, want)
+	}
+}
+
+func TestPolicy_CheckExpanded(t *testing.T) {
+	ch, err := NewCmdChainScript("$x = echo @list\ncat $x")
+	if err != nil {
+		t.Fatalf("NewCmdChainScript() error = %v", err)
+	}
+
+	p, _ := ParsePolicy("allow echo\nallow cat\ndeny cat @*")
+	s := Status{Environment: ch.Environment, Log: &bytes.Buffer{}}
+	s.Constants = map[string]string{}
+	s.Policy = p
+
+	err = RunCmdChain(ch, &s)
+	want := `argument "@list" is denied by the pattern "@*"`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("RunCmdChain() error = %v, want %s", err, want)
+	}
+}
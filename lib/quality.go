@@ -0,0 +1,285 @@
+package paperless
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+
+	util "github.com/kopoli/go-util"
+)
+
+// The handling of the blank pages of the uploads
+const (
+	BlankPagesKeep   = "keep"
+	BlankPagesSkip   = "skip"
+	BlankPagesReject = "reject"
+)
+
+// WarningBlank is the warning of a blank page
+const WarningBlank = "Blank page"
+
+const (
+	// The smallest number of pixels of the shorter side. An A4 page at
+	// 150 dpi has 1240.
+	qualityMinPixels = 1000
+
+	// The smallest resolution in the metadata
+	qualityMinDPI = 150
+
+	// The smallest variance of the Laplacian of the tiles with ink
+	qualityMinSharpness = 100
+
+	// The pages with a smaller fraction of ink pixels are blank
+	qualityMinInk = 0.005
+
+	// The largest skew in degrees that is not warned of
+	qualityMaxSkew = 5.0
+
+	// How much darker than the paper the ink pixels are
+	inkContrast = 64
+
+	// The size of the tiles of the sharpness measurement
+	sharpnessTile = 32
+)
+
+// Quality contains the measurements of an uploaded image
+type Quality struct {
+	Width  int
+	Height int
+
+	// DPI is the resolution from the metadata or 0 if it is not known
+	DPI int
+
+	// Sharpness is the mean variance of the Laplacian of the tiles with
+	// ink. Blurry images have small values.
+	Sharpness float64
+
+	// Ink is the fraction of the pixels that are darker than the paper
+	Ink float64
+
+	// Skew is the angle of the text lines in degrees
+	Skew float64
+
+	Blank    bool
+	Warnings []string
+}
+
+// CheckQuality measures the image and lists the problems that make the text
+// hard to recognize
+func CheckQuality(data []byte) (ret Quality, err error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		err = util.E.Annotate(err, "Decoding the image failed")
+		return
+	}
+
+	pix, w, h := grayPixels(img)
+	ret.Width, ret.Height = w, h
+	ret.DPI = imageDPI(data)
+
+	paper := paperLevel(pix)
+	ink := 0
+	for _, p := range pix {
+		if isInk(p, paper) {
+			ink++
+		}
+	}
+	if len(pix) > 0 {
+		ret.Ink = float64(ink) / float64(len(pix))
+	}
+	ret.Blank = ret.Ink < qualityMinInk
+
+	warn := func(format string, a ...interface{}) {
+		ret.Warnings = append(ret.Warnings, fmt.Sprintf(format, a...))
+	}
+	if w < qualityMinPixels || h < qualityMinPixels {
+		warn("Low resolution: %dx%d pixels", w, h)
+	}
+	if ret.DPI > 0 && ret.DPI < qualityMinDPI {
+		warn("Low resolution: %d dpi", ret.DPI)
+	}
+
+	// The blur and the skew of a blank page can not be measured
+	if ret.Blank {
+		warn(WarningBlank)
+		return
+	}
+
+	ret.Sharpness = sharpness(pix, w, h, paper)
+	if ret.Sharpness < qualityMinSharpness {
+		warn("Blurry: sharpness %.0f", ret.Sharpness)
+	}
+	ret.Skew = skew(pix, w, h, paper)
+	if math.Abs(ret.Skew) > qualityMaxSkew {
+		warn("Skewed: %.1f degrees", ret.Skew)
+	}
+	return
+}
+
+// grayPixels returns the luminance of the pixels row by row
+func grayPixels(img image.Image) (ret []uint8, w, h int) {
+	b := img.Bounds()
+	w, h = b.Dx(), b.Dy()
+	if g, ok := img.(*image.Gray); ok && g.Stride == w {
+		return g.Pix[:w*h], w, h
+	}
+
+	ret = make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			ret[y*w+x] = uint8((299*r + 587*g + 114*bl) / 1000 >> 8)
+		}
+	}
+	return
+}
+
+// paperLevel returns the median luminance that is the color of the paper
+// as most of a page is empty
+func paperLevel(pix []uint8) uint8 {
+	var hist [256]int
+	for _, p := range pix {
+		hist[p]++
+	}
+	sum := 0
+	for i := range hist {
+		sum += hist[i]
+		if sum*2 >= len(pix) {
+			return uint8(i)
+		}
+	}
+	return 255
+}
+
+func isInk(p, paper uint8) bool {
+	return int(p)+inkContrast <= int(paper)
+}
+
+// sharpness returns the mean variance of the Laplacian of the tiles that
+// contain ink. The empty tiles are left out, so a sparse page is not
+// measured as blurry.
+func sharpness(pix []uint8, w, h int, paper uint8) float64 {
+	var total float64
+	tiles := 0
+	for ty := 0; ty+sharpnessTile <= h; ty += sharpnessTile {
+		for tx := 0; tx+sharpnessTile <= w; tx += sharpnessTile {
+			var sum, sum2 float64
+			n, ink := 0, false
+			for y := ty; y < ty+sharpnessTile; y++ {
+				if y == 0 || y == h-1 {
+					continue
+				}
+				for x := tx; x < tx+sharpnessTile; x++ {
+					if x == 0 || x == w-1 {
+						continue
+					}
+					i := y*w + x
+					ink = ink || isInk(pix[i], paper)
+					lap := float64(pix[i-w]) + float64(pix[i+w]) + float64(pix[i-1]) +
+						float64(pix[i+1]) - 4*float64(pix[i])
+					sum += lap
+					sum2 += lap * lap
+					n++
+				}
+			}
+			if ink && n > 0 {
+				mean := sum / float64(n)
+				total += sum2/float64(n) - mean*mean
+				tiles++
+			}
+		}
+	}
+	if tiles == 0 {
+		return 0
+	}
+	return total / float64(tiles)
+}
+
+// skew estimates the angle of the text lines. The ink pixels are projected
+// to the rows of each angle and the angle whose rows are the most uneven is
+// the one where the lines are horizontal.
+func skew(pix []uint8, w, h int, paper uint8) float64 {
+	// Sample at most about 20000 ink pixels
+	var xs, ys []float64
+	step := 1
+	for len(pix)/(step*step) > 4000000 {
+		step++
+	}
+	count := 0
+	for y := 0; y < h; y += step {
+		for x := 0; x < w; x += step {
+			if isInk(pix[y*w+x], paper) {
+				count++
+			}
+		}
+	}
+	every := count/20000 + 1
+	count = 0
+	for y := 0; y < h; y += step {
+		for x := 0; x < w; x += step {
+			if isInk(pix[y*w+x], paper) {
+				if count%every == 0 {
+					xs = append(xs, float64(x))
+					ys = append(ys, float64(y))
+				}
+				count++
+			}
+		}
+	}
+	if len(xs) < 100 {
+		return 0
+	}
+
+	diag := int(math.Hypot(float64(w), float64(h))) + 1
+	bins := make([]int, 2*diag+1)
+	best, bestScore := 0.0, -1.0
+	for a := -15.0; a <= 15.0; a += 0.5 {
+		sin, cos := math.Sincos(a * math.Pi / 180)
+		for i := range bins {
+			bins[i] = 0
+		}
+		for i := range xs {
+			bins[int(ys[i]*cos-xs[i]*sin)+diag]++
+		}
+		score := 0.0
+		for _, c := range bins {
+			score += float64(c) * float64(c)
+		}
+		if score > bestScore {
+			best, bestScore = a, score
+		}
+	}
+	return best
+}
+
+// imageDPI returns the horizontal resolution of the JFIF header of a JPEG
+// or the pHYs chunk of a PNG or 0 if it is not known
+func imageDPI(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff\xe0")) && len(data) >= 18 &&
+		string(data[6:11]) == "JFIF\x00":
+		density := int(binary.BigEndian.Uint16(data[14:]))
+		switch data[13] {
+		case 1:
+			return density
+		case 2:
+			return int(float64(density)*2.54 + 0.5)
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		for pos := 8; pos+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			kind := string(data[pos+4 : pos+8])
+			if kind == "IDAT" || pos+12+length > len(data) {
+				break
+			}
+			if kind == "pHYs" && length == 9 && data[pos+16] == 1 {
+				ppm := binary.BigEndian.Uint32(data[pos+8:])
+				return int(float64(ppm)*0.0254 + 0.5)
+			}
+			pos += 12 + length
+		}
+	}
+	return 0
+}
@@ -0,0 +1,265 @@
+package paperless
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// textPage draws lines of words on a white page rotated by the angle in
+// degrees
+func textPage(w, h int, angle float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	margin := w / 10
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x-w/2), float64(y-h/2)
+			u := int(dx*cos+dy*sin) + w/2
+			v := int(-dx*sin+dy*cos) + h/2
+			c := uint8(230)
+			if u > margin && u < w-margin && v > margin && v < h-margin &&
+				v%40 >= 10 && v%40 < 26 && u%60 >= 5 && u%60 < 50 {
+				c = 30
+			}
+			img.Pix[y*img.Stride+x] = c
+		}
+	}
+	return img
+}
+
+// blur averages the pixels over a square of the radius
+func blur(img *image.Gray, radius int) *image.Gray {
+	b := img.Bounds()
+	ret := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sum, n := 0, 0
+			for sy := y - radius; sy <= y+radius; sy++ {
+				for sx := x - radius; sx <= x+radius; sx++ {
+					if image.Pt(sx, sy).In(b) {
+						sum += int(img.GrayAt(sx, sy).Y)
+						n++
+					}
+				}
+			}
+			ret.Pix[y*ret.Stride+x] = uint8(sum / n)
+		}
+	}
+	return ret
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("Encoding the image failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckQuality(t *testing.T) {
+	blank := textPage(1240, 1754, 0)
+	for i := range blank.Pix {
+		blank.Pix[i] = 230
+	}
+	for i := 0; i < 100; i++ {
+		blank.Pix[i*9973] = 0
+	}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		blank bool
+		want  []string
+	}{
+		{"Good", textPage(1240, 1754, 0), false, nil},
+		{"Small", textPage(600, 800, 0), false, []string{"Low resolution: 600x800 pixels"}},
+		{"Blank", blank, true, []string{WarningBlank}},
+		{"Blurry", blur(textPage(1240, 1754, 0), 4), false, []string{"Blurry"}},
+		{"Skewed", textPage(1240, 1754, 10), false, []string{"Skewed: 10.0 degrees"}},
+		{"Slightly skewed", textPage(1240, 1754, 2), false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckQuality(encodePNG(t, tt.img))
+			if err != nil {
+				t.Fatalf("CheckQuality() error = %v", err)
+			}
+			if got.Blank != tt.blank {
+				t.Errorf("CheckQuality() blank = %v, want %v", got.Blank, tt.blank)
+			}
+			if len(got.Warnings) != len(tt.want) {
+				t.Fatalf("CheckQuality() warnings = %q, want %q", got.Warnings, tt.want)
+			}
+			for i := range tt.want {
+				if !strings.HasPrefix(got.Warnings[i], tt.want[i]) {
+					t.Errorf("CheckQuality() warning %q, want %q", got.Warnings[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_imageDPI(t *testing.T) {
+	pngData := encodePNG(t, image.NewGray(image.Rect(0, 0, 10, 10)))
+
+	// The pHYs chunk after the IHDR with 11811 pixels per meter. The CRC
+	// is not checked.
+	phys := []byte("\x00\x00\x00\x09pHYs\x00\x00\x2e\x23\x00\x00\x2e\x23\x01\x00\x00\x00\x00")
+	withPhys := append(append(append([]byte{}, pngData[:33]...), phys...), pngData[33:]...)
+
+	jfif := func(units byte, density uint16) []byte {
+		return []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00,
+			0x01, 0x01, units, byte(density >> 8), byte(density), byte(density >> 8), byte(density),
+			0x00, 0x00}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"PNG without pHYs", pngData, 0},
+		{"PNG with pHYs", withPhys, 300},
+		{"JPEG in dpi", jfif(1, 200), 200},
+		{"JPEG in dots per cm", jfif(2, 118), 300},
+		{"JPEG aspect ratio only", jfif(0, 1), 0},
+		{"Other", []byte("GIF89a"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageDPI(tt.data); got != tt.want {
+				t.Errorf("imageDPI() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveBatch_blankPages(t *testing.T) {
+	destdir, err := ioutil.TempDir("", "blank")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+	_, err = db.addScript(Script{Name: "default", Script: "true"}, "", "")
+	if err != nil {
+		t.Fatalf("Adding the script failed: %v", err)
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 1240, 1754))
+	for i := range blank.Pix {
+		blank.Pix[i] = 230
+	}
+	pages := []UploadPage{
+		{"text.png", encodePNG(t, textPage(1240, 1754, 0))},
+		{"blank.png", encodePNG(t, blank)},
+	}
+
+	tests := []struct {
+		blankPages string
+		want       int
+		wantErr    bool
+	}{
+		{BlankPagesReject, 0, true},
+		{BlankPagesSkip, 1, false},
+		{BlankPagesKeep, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.blankPages, func(t *testing.T) {
+			conf := &ProcessConfig{BlankPages: tt.blankPages}
+			images, err := SaveBatch(pages, "scan", "", time.Time{}, conf, db, destdir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SaveBatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(images) != tt.want {
+				t.Fatalf("SaveBatch() got %d images, want %d", len(images), tt.want)
+			}
+			for _, img := range images {
+				if img.Warnings != "" && img.Warnings != WarningBlank {
+					t.Errorf("Unexpected warnings: %q", img.Warnings)
+				}
+				err = DeleteImage(&img, db, destdir)
+				if err != nil {
+					t.Fatalf("Deleting the image failed: %v", err)
+				}
+			}
+			if len(images) == 2 && images[1].Warnings != WarningBlank {
+				t.Errorf("The blank page should be warned of: %q", images[1].Warnings)
+			}
+		})
+	}
+}
+
+func TestSaveBatch_blankSeparator(t *testing.T) {
+	// The blank pages are checked with the default decoder
+	RegisterBarcodeDecoder("page", pageDecoder{})
+	RegisterBarcodeDecoder("zbar", pageDecoder{})
+	defer delete(barcodeDecoders, "page")
+	defer RegisterBarcodeDecoder("zbar", ZbarDecoder{})
+
+	destdir, err := ioutil.TempDir("", "blank")
+	if err != nil {
+		t.Fatalf("Creating a directory failed: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	// Each run of the script adds a line to the file
+	runs := filepath.Join(destdir, "runs")
+	script := "@barcodes decoder=page $input $tmpCodes\nsh -c \"echo run >> " + runs + "\""
+	_, err = db.addScript(Script{Name: "default", Script: script}, "", "")
+	if err != nil {
+		t.Fatalf("Adding the script failed: %v", err)
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 1240, 1754))
+	for i := range blank.Pix {
+		blank.Pix[i] = 230
+	}
+
+	// The page decoder reads the code after the end of the PNG
+	separator := append(encodePNG(t, blank), "\nCODE:PATCHT\n"...)
+	pages := []UploadPage{
+		{"1.png", encodePNG(t, textPage(1240, 1754, 0))},
+		{"sep.png", separator},
+		{"2.png", encodePNG(t, textPage(1240, 1750, 0))},
+		{"blank.png", encodePNG(t, blank)},
+	}
+
+	conf := &ProcessConfig{SeparatorCode: "PATCHT", BlankPages: BlankPagesSkip}
+	images, err := SaveBatch(pages, "scan", "", time.Time{}, conf, db, destdir)
+	if err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("SaveBatch() got %d images, want 2", len(images))
+	}
+	if images[0].Document == images[1].Document {
+		t.Errorf("The separator sheet should start a new document: %d, %d",
+			images[0].Document, images[1].Document)
+	}
+
+	// The blank page without barcodes is skipped without running the script
+	data, err := ioutil.ReadFile(runs)
+	if err != nil || strings.Count(string(data), "run") != 3 {
+		t.Errorf("The script was run %d times, want 3: %v", strings.Count(string(data), "run"), err)
+	}
+}
@@ -0,0 +1,228 @@
+package paperless
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	util "github.com/kopoli/go-util"
+)
+
+// The BM25 parameters: the saturation of the term frequency and the effect
+// of the length of the document
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// relatedMinScore is the smallest relative score of a related image. It
+// leaves out the images that share only the tags that nearly all have.
+const relatedMinScore = 0.02
+
+// RelatedImage is an image and how similar it is to another one
+type RelatedImage struct {
+	Image
+
+	// Score is the BM25 score relative to the score of the other image
+	// against itself, so the most similar images are near 1
+	Score float64
+}
+
+// relatedTerms returns the words of the text and the comment of the image
+// and its tags. The tags are prefixed with # that is not part of a word.
+func relatedTerms(img *Image) (ret []string) {
+	ret = textTerms(img.Text + "\n" + img.Comment)
+	for _, t := range img.Tags {
+		ret = append(ret, "#"+t.Name)
+	}
+	return
+}
+
+// relatedIndex has the BM25 statistics of the terms of all images
+type relatedIndex struct {
+	// docs are the counts of the terms of the images by their ids
+	docs map[int]map[string]int
+
+	// lengths are the numbers of the terms of the images by their ids
+	lengths map[int]int
+
+	// df is the number of the images that have the term
+	df map[string]int
+
+	total int
+}
+
+// relatedCache keeps the relatedIndex between the queries. The index is
+// built when it is needed and dropped when the images or the tags change.
+type relatedCache struct {
+	mutex sync.Mutex
+	index *relatedIndex
+
+	// generation is incremented on each change, so an index built from
+	// the images before a change is not kept
+	generation int
+}
+
+func newRelatedIndex(images []Image) *relatedIndex {
+	ret := &relatedIndex{
+		docs:    make(map[int]map[string]int, len(images)),
+		lengths: make(map[int]int, len(images)),
+		df:      map[string]int{},
+	}
+	for i := range images {
+		doc := map[string]int{}
+		terms := relatedTerms(&images[i])
+		for _, t := range terms {
+			if doc[t] == 0 {
+				ret.df[t]++
+			}
+			doc[t]++
+		}
+		ret.docs[images[i].Id] = doc
+		ret.lengths[images[i].Id] = len(terms)
+		ret.total += len(terms)
+	}
+	return ret
+}
+
+// scores scores the images by their BM25 relevance to the terms of the
+// image with the id. The tags are terms as well, so sharing a rare tag
+// counts more than sharing a tag that all images have. The images with too
+// low scores and the image itself are left out.
+func (r *relatedIndex) scores(id int) (ret map[int]float64, err error) {
+	target, ok := r.docs[id]
+	if !ok {
+		return nil, util.E.New("Image %d not found", id)
+	}
+
+	ret = map[int]float64{}
+	if r.total == 0 {
+		return
+	}
+	n := float64(len(r.docs))
+	avgdl := float64(r.total) / n
+
+	bm25 := func(doc map[string]int, length int) (ret float64) {
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(length)/avgdl)
+		for t := range target {
+			tf := float64(doc[t])
+			if tf == 0 {
+				continue
+			}
+			d := float64(r.df[t])
+			idf := math.Log((n-d+0.5)/(d+0.5) + 1)
+			ret += idf * tf * (bm25K1 + 1) / (tf + norm)
+		}
+		return
+	}
+
+	self := bm25(target, r.lengths[id])
+	if self == 0 {
+		return
+	}
+	for other, doc := range r.docs {
+		if other == id {
+			continue
+		}
+		if score := bm25(doc, r.lengths[other]) / self; score >= relatedMinScore {
+			ret[other] = score
+		}
+	}
+	return
+}
+
+// relatedIndex returns the cached index or builds it from all images
+func (db *db) relatedIndex() (ret *relatedIndex, err error) {
+	db.related.mutex.Lock()
+	ret = db.related.index
+	generation := db.related.generation
+	db.related.mutex.Unlock()
+	if ret != nil {
+		return
+	}
+
+	all, err := db.getImages(nil, nil)
+	if err != nil {
+		return
+	}
+	ret = newRelatedIndex(all.Images)
+
+	db.related.mutex.Lock()
+	if db.related.generation == generation {
+		db.related.index = ret
+	}
+	db.related.mutex.Unlock()
+	return
+}
+
+// invalidateRelated drops the cached index after the images or the tags
+// have changed
+func (db *db) invalidateRelated() {
+	db.related.mutex.Lock()
+	db.related.index = nil
+	db.related.generation++
+	db.related.mutex.Unlock()
+}
+
+// relatedTo scores the images by their relevance to the image with the id
+func (db *db) relatedTo(id int) (scores map[int]float64, err error) {
+	index, err := db.relatedIndex()
+	if err != nil {
+		return
+	}
+	return index.scores(id)
+}
+
+// rankRelated orders the ids by their relevance to the image with the id
+// like. The ids of the images that are not related are left out.
+func (db *db) rankRelated(like int, ids []int) (ret []int, err error) {
+	scores, err := db.relatedTo(like)
+	if err != nil {
+		return
+	}
+
+	ret = []int{}
+	for _, id := range ids {
+		if _, ok := scores[id]; ok {
+			ret = append(ret, id)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return scores[ret[i]] > scores[ret[j]]
+	})
+	return
+}
+
+// Related returns at most count images that are the most similar to the
+// image with the id, the most similar first
+func Related(db *db, id int, count int) (ret []RelatedImage, err error) {
+	scores, err := db.relatedTo(id)
+	if err != nil {
+		return
+	}
+
+	var ids []int
+	for other := range scores {
+		ids = append(ids, other)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > count {
+		ids = ids[:count]
+	}
+
+	ret = []RelatedImage{}
+	for _, other := range ids {
+		var img Image
+		img, err = db.getImage(other)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, RelatedImage{img, scores[other]})
+	}
+	return
+}
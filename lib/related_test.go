@@ -0,0 +1,107 @@
+package paperless
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelated(t *testing.T) {
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	images := []Image{
+		{Checksum: "1", Text: "Helen Oy lasku sähkö marraskuu kulutus 230 kWh yhteensä 45,20",
+			Tags: []Tag{{Name: "scan"}, {Name: "bills"}}},
+		{Checksum: "2", Text: "Kesko kuitti maito leipä juusto yhteensä 12,40",
+			Tags: []Tag{{Name: "scan"}}},
+		{Checksum: "3", Text: "Helen Oy lasku sähkö lokakuu kulutus 210 kWh yhteensä 41,10",
+			Tags: []Tag{{Name: "scan"}, {Name: "bills"}}},
+		{Checksum: "4", Text: "Vakuutusyhtiö kotivakuutus lasku vuosimaksu",
+			Tags: []Tag{{Name: "scan"}, {Name: "bills"}}},
+		{Checksum: "5", Text: "Helen Oy sopimus sähkö toimitus",
+			Tags: []Tag{{Name: "scan"}}},
+		{Checksum: "6", Text: "", Tags: []Tag{{Name: "scan"}}},
+	}
+	for _, img := range images {
+		for _, tag := range img.Tags {
+			_, _ = db.addTag(tag)
+		}
+		_, err = db.addImage(img)
+		if err != nil {
+			t.Fatalf("Adding an image failed: %v", err)
+		}
+	}
+
+	related, err := Related(db, 1, 10)
+	if err != nil {
+		t.Fatalf("Related() error = %v", err)
+	}
+	var ids []int
+	for _, r := range related {
+		ids = append(ids, r.Id)
+	}
+
+	// The invoice of the same sender, the contract of the sender, another
+	// bill and a receipt with a common word. The image without text shares
+	// only the tag all images have.
+	if want := []int{3, 5, 4, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Related() = %v, want %v", ids, want)
+	}
+	for i := 1; i < len(related); i++ {
+		if related[i].Score > related[i-1].Score || related[i].Score <= 0 {
+			t.Errorf("Related() scores not in order: %v, %v", related[i-1].Score, related[i].Score)
+		}
+	}
+
+	// The like qualifier orders the search results the same way
+	s, err := ParseSearch("like:1 sähkö")
+	if err != nil {
+		t.Fatalf("ParseSearch() error = %v", err)
+	}
+	found, err := db.getImages(nil, &s)
+	if err != nil {
+		t.Fatalf("getImages() error = %v", err)
+	}
+	ids = nil
+	for _, img := range found.Images {
+		ids = append(ids, img.Id)
+	}
+	if want := []int{3, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("getImages() like:1 = %v, want %v", ids, want)
+	}
+
+	if _, err = Related(db, 42, 3); err == nil {
+		t.Errorf("Related() of a missing image should fail")
+	}
+
+	// The statistics are kept between the queries and rebuilt after an
+	// edit
+	index := db.related.index
+	if index == nil {
+		t.Fatalf("The related index should be cached")
+	}
+	_, err = Related(db, 1, 10)
+	if err != nil || db.related.index != index {
+		t.Errorf("The related index should be reused: %v", err)
+	}
+
+	img, err := db.getImage(6)
+	if err != nil {
+		t.Fatalf("getImage() error = %v", err)
+	}
+	img.Text = images[0].Text
+	err = db.updateImage(img)
+	if err != nil {
+		t.Fatalf("updateImage() error = %v", err)
+	}
+	if db.related.index != nil {
+		t.Errorf("The related index should be dropped after an edit")
+	}
+	related, err = Related(db, 1, 1)
+	if err != nil || len(related) != 1 || related[0].Id != 6 {
+		t.Errorf("Related() after an edit = %v, %v, want image 6", related, err)
+	}
+}
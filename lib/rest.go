@@ -4,10 +4,14 @@ package paperless
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,6 +25,7 @@ import (
 	"github.com/go-chi/docgen"
 
 	"github.com/kopoli/go-util"
+	"gopkg.in/yaml.v2"
 )
 
 type backend struct {
@@ -29,6 +34,12 @@ type backend struct {
 	imgdir  string
 
 	staticURL string
+
+	// Directory and URL of the script trial outputs
+	trialdir string
+	trialURL string
+
+	process ProcessConfig
 }
 
 /// JSON responding
@@ -90,6 +101,10 @@ func (b *backend) tagHandler(w http.ResponseWriter, r *http.Request) {
 			annotate("JSON parsing failed")
 			goto requestError
 		}
+		_, err = ParseParams(t.Params)
+		if err != nil {
+			goto requestError
+		}
 		t, err = b.db.addTag(t)
 		if err != nil {
 			annotate("Adding tag to db failed")
@@ -140,12 +155,17 @@ func (b *backend) singleTagHandler(w http.ResponseWriter, r *http.Request) {
 		jsend.Wrap(w).Status(http.StatusOK).Data(t).Send()
 	case "PUT":
 		var t2 Tag
-		err = requestJson(r, &t)
+		err = requestJson(r, &t2)
 		if err != nil {
 			annotate("JSON parsing failed")
 			goto requestError
 		}
+		_, err = ParseParams(t2.Params)
+		if err != nil {
+			goto requestError
+		}
 		t.Comment = t2.Comment
+		t.Params = t2.Params
 		err = b.db.updateTag(t)
 		if err != nil {
 			annotate("Updating tag in db failed")
@@ -179,6 +199,8 @@ type resultimg struct {
 type restimg struct {
 	Image
 
+	Warnings []string
+
 	OrigImg  string
 	CleanImg string
 	ThumbImg string
@@ -189,6 +211,7 @@ func (b *backend) wrapImage(img *Image) (ret restimg) {
 		return b.staticURL + "/" + filepath.Base(s)
 	}
 	ret.Image = *img
+	ret.Warnings = img.WarningList()
 	ret.OrigImg = strip(img.OrigFile(""))
 	ret.CleanImg = strip(img.CleanFile(""))
 	ret.ThumbImg = strip(img.ThumbFile(""))
@@ -206,6 +229,19 @@ func (b *backend) wrapImages(imgs ImageResult) (ret resultimg) {
 	return
 }
 
+// readFormFile reads the contents of the uploaded file
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, file)
+	return buf.Bytes(), err
+}
+
 func (b *backend) imageHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 	annotate := func(arg ...interface{}) {
@@ -219,10 +255,9 @@ func (b *backend) imageHandler(w http.ResponseWriter, r *http.Request) {
 			annotate("Parsing multipartform failed")
 			goto requestError
 		}
-		file, header, e2 := r.FormFile("image")
-		if e2 != nil {
-			err = e2
-			annotate("Could not find image from POST data")
+		files := r.MultipartForm.File["image"]
+		if len(files) == 0 {
+			err = util.E.New("Could not find image from POST data")
 			goto requestError
 		}
 		tags := r.FormValue("tags")
@@ -230,41 +265,71 @@ func (b *backend) imageHandler(w http.ResponseWriter, r *http.Request) {
 			err = util.E.New("Tags are required when uploading.")
 			goto requestError
 		}
-		buf := &bytes.Buffer{}
-		_, err = io.Copy(buf, file)
+		params := r.FormValue("params")
+		_, err = ParseParams(params)
 		if err != nil {
-			annotate("Could not copy image data to buffer")
 			goto requestError
 		}
+		var date time.Time
+		if str := r.FormValue("date"); str != "" {
+			date, err = time.ParseInLocation("2006-01-02", str, time.Local)
+			if err != nil {
+				annotate("Invalid date, expected YYYY-MM-DD")
+				goto requestError
+			}
+		}
+		conf := b.process
+		if str := r.FormValue("blankpages"); str != "" {
+			if !ValidBlankPages(str) {
+				err = util.E.New("Invalid blankpages: %s", str)
+				goto requestError
+			}
+			conf.BlankPages = str
+		}
+		pages := make([]UploadPage, len(files))
+		for i, header := range files {
+			pages[i].Filename = header.Filename
+			pages[i].Data, err = readFormFile(header)
+			if err != nil {
+				annotate("Could not copy image data to buffer")
+				goto requestError
+			}
+		}
 
-		img, e2 := SaveImage(header.Filename, buf.Bytes(), b.db, b.imgdir, tags)
+		// Several files are pages of a batch that separator sheets split
+		// to documents
+		images, e2 := SaveBatch(pages, tags, params, date, &conf, b.db, b.imgdir)
 		if e2 != nil {
 			err = e2
 			annotate("Could not save image")
 			goto requestError
 		}
 
-		err = ProcessImage(&img, "default", b.db, b.imgdir)
-		if err != nil {
-			annotate("Could not process image")
-			// Ignore errors with this as the data could be
-			// incomplete before deletion
-			_ = DeleteImage(&img, b.db, b.imgdir)
-			goto requestError
+		// The response is the list of the images also when a single
+		// file is uploaded
+		ret := make([]restimg, len(images))
+		for i := range images {
+			ret[i] = b.wrapImage(&images[i])
 		}
-
-		jsend.Wrap(w).Status(http.StatusCreated).Data(img).Send()
+		jsend.Wrap(w).Status(http.StatusCreated).Data(ret).Send()
 	case "GET":
 		p := getPaging(r)
 		query := r.URL.Query().Get("q")
 		tag := r.URL.Query().Get("t")
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
 
-		s := &Search{
-			Match: query,
-			Tag: tag,
+		s, e2 := ParseSearch(query)
+		if e2 != nil {
+			err = e2
+			annotate("Parsing the search failed")
+			goto requestError
 		}
+		s.Tag = tag
+		s.Script = r.URL.Query().Get("script")
+		s.ScriptVersion = version
+		s.Document, _ = strconv.Atoi(r.URL.Query().Get("document"))
 
-		images, e2 := b.db.getImages(p, s)
+		images, e2 := b.db.getImages(p, &s)
 		if e2 != nil {
 			err = e2
 			annotate("Getting images from db failed")
@@ -310,6 +375,14 @@ func (b *backend) singleImageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		img.Text = img2.Text
 		img.Comment = img2.Comment
+		img.Paid = img2.Paid
+		img.ASN = img2.ASN
+		img.RemindDays = img2.RemindDays
+		// A request without a due date keeps the current one
+		if !img2.DueDate.IsZero() && !img2.DueDate.Equal(img.DueDate) {
+			img.DueDate = dateUTC(img2.DueDate)
+			img.DueSource = DateSourceExplicit
+		}
 		err = b.db.updateImage(img)
 		if err != nil {
 			annotate("Updating image in db failed")
@@ -332,13 +405,798 @@ requestError:
 	return
 }
 
+// imageProcessHandler processes the image again with the script given in
+// the script parameter
+func (b *backend) imageProcessHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var img Image
+	scriptname := r.URL.Query().Get("script")
+	if scriptname == "" {
+		scriptname = "default"
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err == nil {
+		img, err = b.db.getImage(id)
+	}
+	if err != nil {
+		annotate("Invalid image ID from URL")
+		goto requestError
+	}
+
+	err = ProcessImage(&img, scriptname, &b.process, b.db, b.imgdir)
+	if err != nil {
+		annotate("Could not process image")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(b.wrapImage(&img)).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// imageRotateHandler adds a clockwise rotation by the angle parameter to the
+// image and processes it again with the script that processed it
+func (b *backend) imageRotateHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var img Image
+	var angle int
+	var scriptname string
+
+	id, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err == nil {
+		img, err = b.db.getImage(id)
+	}
+	if err != nil {
+		annotate("Invalid image ID from URL")
+		goto requestError
+	}
+
+	angle, err = strconv.Atoi(r.URL.Query().Get("angle"))
+	if err != nil {
+		annotate("Invalid angle")
+		goto requestError
+	}
+
+	err = RotateImage(&img, angle)
+	if err != nil {
+		annotate("Could not rotate image")
+		goto requestError
+	}
+
+	scriptname = img.ScriptName
+	if scriptname == "" {
+		scriptname = "default"
+	}
+	err = ProcessImage(&img, scriptname, &b.process, b.db, b.imgdir)
+	if err != nil {
+		annotate("Could not process image")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(b.wrapImage(&img)).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// restrelated is a related image and its score
+type restrelated struct {
+	restimg
+
+	Score float64
+}
+
+// imageRelatedHandler lists the images that are the most similar to the
+// image. The count parameter is the maximum number of images.
+func (b *backend) imageRelatedHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var related []RelatedImage
+	var ret []restrelated
+	count := 10
+
+	id, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		annotate("Invalid image ID from URL")
+		goto requestError
+	}
+
+	if str := r.URL.Query().Get("count"); str != "" {
+		count, err = strconv.Atoi(str)
+		if err == nil && count <= 0 {
+			err = util.E.New("Count must be positive")
+		}
+		if err != nil {
+			annotate("Invalid count")
+			goto requestError
+		}
+	}
+
+	related, err = Related(b.db, id, count)
+	if err != nil {
+		annotate("Finding the related images failed")
+		goto requestError
+	}
+
+	ret = make([]restrelated, len(related))
+	for i := range related {
+		ret[i] = restrelated{b.wrapImage(&related[i].Image), related[i].Score}
+	}
+	jsend.Wrap(w).Status(http.StatusOK).Data(ret).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// reviewHandler lists the images that need a review
+func (b *backend) reviewHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := b.db.getImages(getPaging(r), &Search{Review: true})
+	if err != nil {
+		err = util.E.Annotate(err, "Getting images from db failed")
+		b.respondErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(b.wrapImages(images)).Send()
+}
+
+// imageReviewedHandler marks the image as reviewed. The corrected text is
+// given with PUT to the image.
+func (b *backend) imageReviewedHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var img Image
+
+	id, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err == nil {
+		img, err = b.db.getImage(id)
+	}
+	if err != nil {
+		annotate("Invalid image ID from URL")
+		goto requestError
+	}
+
+	img.NeedsReview = false
+	err = b.db.updateImage(img)
+	if err != nil {
+		annotate("Updating image in db failed")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(b.wrapImage(&img)).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// upcomingDays returns the days parameter of the request
+func upcomingDays(r *http.Request, def int) (int, error) {
+	str := r.URL.Query().Get("days")
+	if str == "" {
+		return def, nil
+	}
+	days, err := strconv.Atoi(str)
+	if err == nil && days < 0 {
+		err = util.E.New("Negative days")
+	}
+	return days, err
+}
+
+// upcomingHandler lists the images that are due within the days parameter
+func (b *backend) upcomingHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var images []Image
+	var ret []restimg
+
+	days, err := upcomingDays(r, 30)
+	if err != nil {
+		annotate("Invalid days")
+		goto requestError
+	}
+
+	images, err = Upcoming(b.db, time.Now(), days)
+	if err != nil {
+		annotate("Getting images from db failed")
+		goto requestError
+	}
+
+	ret = make([]restimg, len(images))
+	for i := range images {
+		ret[i] = b.wrapImage(&images[i])
+	}
+	jsend.Wrap(w).Status(http.StatusOK).Data(ret).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// upcomingICSHandler serves the due dates as an iCalendar feed
+func (b *backend) upcomingICSHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var images []Image
+	var host string
+
+	days, err := upcomingDays(r, 365)
+	if err != nil {
+		annotate("Invalid days")
+		goto requestError
+	}
+
+	images, err = Upcoming(b.db, time.Now(), days)
+	if err != nil {
+		annotate("Getting images from db failed")
+		goto requestError
+	}
+
+	host = r.Host
+	if h, _, e2 := net.SplitHostPort(host); e2 == nil {
+		host = h
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(UpcomingICS(images, time.Now(), host, "http://"+r.Host+"/api/v1/image"))
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// asnHandler returns the image with the archive serial number
+func (b *backend) asnHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var img Image
+
+	asn, err := strconv.Atoi(chi.URLParam(r, "asn"))
+	if err != nil {
+		annotate("Invalid archive serial number from URL")
+		goto requestError
+	}
+
+	img, err = b.db.getImageByASN(asn)
+	if err == sql.ErrNoRows {
+		b.respondErr(w, http.StatusNotFound,
+			util.E.New("No image found with archive serial number %d", asn))
+		return
+	}
+	if err != nil {
+		annotate("Getting image from db failed")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(b.wrapImage(&img)).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// asnLabelsHandler serves a PDF of the label sheets of the next archive
+// serial numbers. The count parameter is the number of labels. The printed
+// numbers are reserved, so they are not assigned to the uploaded images.
+func (b *backend) asnLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var start int
+	var pdf []byte
+	count := MaxLabels
+
+	if str := r.URL.Query().Get("count"); str != "" {
+		count, err = strconv.Atoi(str)
+		if err != nil {
+			annotate("Invalid count")
+			goto requestError
+		}
+	}
+	if count <= 0 || count > MaxLabelSheets*MaxLabels {
+		err = util.E.New("Invalid count %d, the maximum is %d",
+			count, MaxLabelSheets*MaxLabels)
+		goto requestError
+	}
+
+	start, err = b.db.reserveASNs(count)
+	if err != nil {
+		annotate("Reserving the archive serial numbers failed")
+		goto requestError
+	}
+
+	pdf, err = LabelsPDF(start, count)
+	if err != nil {
+		annotate("Drawing the labels failed")
+		goto requestError
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Write(pdf)
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// duplicatesHandler lists the clusters of the images that are likely
+// duplicates of each other
+func (b *backend) duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var clusters [][]Image
+	var ret [][]restimg
+
+	images, err := b.db.getImages(nil, nil)
+	if err != nil {
+		annotate("Getting images from db failed")
+		goto requestError
+	}
+
+	clusters = DuplicateClusters(images.Images)
+	ret = make([][]restimg, len(clusters))
+	for i := range clusters {
+		ret[i] = make([]restimg, len(clusters[i]))
+		for j := range clusters[i] {
+			ret[i][j] = b.wrapImage(&clusters[i][j])
+		}
+	}
+	jsend.Wrap(w).Status(http.StatusOK).Data(ret).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
 /// Script handling
 
+// scriptEdit is a new script or a new version of a script. The script is
+// given either as text in Script or in the structured form in Spec.
+type scriptEdit struct {
+	Name    string     `yaml:"Name"`
+	Script  string     `yaml:"Script"`
+	Spec    *ChainSpec `yaml:"Spec"`
+	Author  string     `yaml:"Author"`
+	Message string     `yaml:"Message"`
+}
+
+// restScript is a script with its structured form. The Spec is omitted if
+// the script can not be converted to it.
+type restScript struct {
+	Id      int        `yaml:"Id"`
+	Name    string     `yaml:"Name"`
+	Script  string     `yaml:"Script"`
+	Version int        `yaml:"Version"`
+	Spec    *ChainSpec `json:",omitempty" yaml:"Spec,omitempty"`
+}
+
+// isYAML tells if the media type of the header is YAML
+func isYAML(header string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(strings.Split(t, ";")[0])
+		if t == "application/yaml" || t == "application/x-yaml" || t == "text/yaml" {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScriptEdit parses the script edit from the request body as YAML if
+// its Content-Type is YAML and otherwise as JSON. The Spec is converted to
+// the script text that is stored.
+func requestScriptEdit(r *http.Request, e *scriptEdit) (err error) {
+	if isYAML(r.Header.Get("Content-Type")) {
+		var text []byte
+		text, err = ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = yaml.UnmarshalStrict(text, e)
+		}
+		if err != nil {
+			return util.E.Annotate(err, "YAML parsing failed")
+		}
+	} else {
+		err = requestJson(r, e)
+		if err != nil {
+			return util.E.Annotate(err, "JSON parsing failed")
+		}
+	}
+
+	if e.Spec != nil {
+		if e.Script != "" {
+			return util.E.New("Only one of Script and Spec can be given")
+		}
+		e.Script, err = e.Spec.Script()
+		if err != nil {
+			return util.E.Annotate(err, "Invalid script spec")
+		}
+	}
+	return
+}
+
+// respondScript sends the script with its structured form as YAML if the
+// request accepts it and otherwise as JSON
+func (b *backend) respondScript(w http.ResponseWriter, r *http.Request, status int, s Script) {
+	ret := restScript{Id: s.Id, Name: s.Name, Script: s.Script, Version: s.Version}
+	if spec, err := ScriptSpec(s.Script); err == nil {
+		ret.Spec = &spec
+	}
+
+	if !isYAML(r.Header.Get("Accept")) {
+		jsend.Wrap(w).Status(status).Data(ret).Send()
+		return
+	}
+
+	data, err := yaml.Marshal(ret)
+	if err != nil {
+		b.respondErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (b *backend) scriptHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	switch r.Method {
+	case "POST":
+		var e scriptEdit
+		var s Script
+		err = requestScriptEdit(r, &e)
+		if err != nil {
+			goto requestError
+		}
+		s, err = b.db.addScript(Script{Name: e.Name, Script: e.Script}, e.Author, e.Message)
+		if err != nil {
+			annotate("Adding script to db failed")
+			goto requestError
+		}
+
+		b.respondScript(w, r, http.StatusCreated, s)
+	case "GET":
+		p := getPaging(r)
+
+		scripts, e2 := b.db.getScripts(p)
+		if e2 != nil {
+			err = e2
+			annotate("Getting scripts from db failed")
+			goto requestError
+		}
+
+		jsend.Wrap(w).Status(http.StatusOK).Data(scripts).Send()
+	}
+
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+func (b *backend) singleScriptHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	s := r.Context().Value(ctxScript).(Script)
+
+	switch r.Method {
+	case "GET":
+		b.respondScript(w, r, http.StatusOK, s)
+	case "PUT":
+		var e scriptEdit
+		err = requestScriptEdit(r, &e)
+		if err != nil {
+			goto requestError
+		}
+		s.Script = e.Script
+		err = b.db.updateScript(s, e.Author, e.Message)
+		if err == nil {
+			s, err = b.db.getScript(s.Id)
+		}
+		if err != nil {
+			annotate("Updating script in db failed")
+			goto requestError
+		}
+		b.respondScript(w, r, http.StatusOK, s)
+	case "DELETE":
+		err = b.db.deleteScript(s)
+		if err != nil {
+			annotate("Deleting script from db failed")
+			goto requestError
+		}
+		jsend.Wrap(w).Status(http.StatusOK).Message("Deleted").Send()
+	}
+
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+func (b *backend) scriptVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	s := r.Context().Value(ctxScript).(Script)
+
+	versions, err := b.db.getScriptVersions(s.Id)
+	if err != nil {
+		err = util.E.Annotate(err, "Getting script versions from db failed")
+		b.respondErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(versions).Send()
+}
+
+func (b *backend) scriptVersionHandler(w http.ResponseWriter, r *http.Request) {
+	var v ScriptVersion
+	s := r.Context().Value(ctxScript).(Script)
+
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err == nil {
+		v, err = b.db.getScriptVersion(s.Id, version)
+	}
+	if err != nil {
+		err = util.E.Annotate(err, "Invalid script version from URL")
+		b.respondErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(v).Send()
+}
+
+type resultdiff struct {
+	From int
+	To   int
+	Diff string
+}
+
+// scriptDiffHandler returns the diff between the versions given in the
+// from and to parameters. By default the diff is from the previous version
+// to the current one.
+func (b *backend) scriptDiffHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var from, to ScriptVersion
+	s := r.Context().Value(ctxScript).(Script)
+	version := func(name string, def int) (ret ScriptVersion, err error) {
+		v := def
+		if str := r.URL.Query().Get(name); str != "" {
+			v, err = strconv.Atoi(str)
+			if err != nil {
+				return
+			}
+		}
+		// The version 0 is the empty script before the first version
+		if v == 0 {
+			return
+		}
+		return b.db.getScriptVersion(s.Id, v)
+	}
+
+	to, err = version("to", s.Version)
+	if err == nil {
+		from, err = version("from", to.Version-1)
+	}
+	if err != nil {
+		annotate("Invalid script version")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(resultdiff{
+		From: from.Version,
+		To:   to.Version,
+		Diff: TextDiff(from.Script, to.Script),
+	}).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+// scriptRollback is a request to restore an earlier version of a script
+type scriptRollback struct {
+	Version int
+	Author  string
+}
+
+func (b *backend) scriptRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var rb scriptRollback
+	s := r.Context().Value(ctxScript).(Script)
+
+	err = requestJson(r, &rb)
+	if err != nil {
+		annotate("JSON parsing failed")
+		goto requestError
+	}
+
+	err = b.db.rollbackScript(s, rb.Version, rb.Author)
+	if err == nil {
+		s, err = b.db.getScript(s.Id)
+	}
+	if err != nil {
+		annotate("Rolling back the script failed")
+		goto requestError
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(s).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+type ctxKey int
+
+const ctxScript ctxKey = iota
+
 func (b *backend) loadScriptCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s Script
+
+		id, err := strconv.Atoi(chi.URLParam(r, "scriptID"))
+		if err == nil {
+			s, err = b.db.getScript(id)
+		}
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid script ID from URL")
+			b.respondErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxScript, s)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+type resulttrial struct {
+	Text     string
+	Diff     string
+	CleanImg string
+	ThumbImg string
+	Log      string
+}
+
+func (b *backend) scriptTrialHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var img Image
+	var res TrialResult
+	var ret resulttrial
+	script := r.Context().Value(ctxScript).(Script)
+	strip := func(s string) string {
+		rel, _ := filepath.Rel(b.trialdir, s)
+		return b.trialURL + "/" + filepath.ToSlash(rel)
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("image"))
+	if err == nil {
+		img, err = b.db.getImage(id)
+	}
+	if err != nil {
+		annotate("Invalid image ID in the image parameter")
+		goto requestError
+	}
+
+	if p, ok := r.URL.Query()["params"]; ok {
+		img.Params = p[0]
+	}
+
+	err = CleanTrials(b.trialdir, time.Hour)
+	if err != nil {
+		annotate("Removing old trials failed")
+		goto requestError
+	}
+
+	res, err = TrialScript(&img, script, &b.process, b.db, b.imgdir, b.trialdir)
+	if err != nil {
+		annotate("Running the script failed. Log:\n", res.Log)
+		goto requestError
+	}
+
+	ret = resulttrial{
+		Text:     res.Text,
+		Diff:     res.Diff,
+		CleanImg: strip(res.CleanFile),
+		ThumbImg: strip(res.ThumbFile),
+		Log:      res.Log,
+	}
+	jsend.Wrap(w).Status(http.StatusOK).Data(ret).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
+func (b *backend) scriptLintHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	annotate := func(arg ...interface{}) {
+		err = util.E.Annotate(err, arg...)
+	}
+
+	var script Script
+	var e Environment
+
+	err = requestJson(r, &script)
+	if err != nil {
+		annotate("JSON parsing failed")
+		goto requestError
+	}
+
+	e.Constants = imageConstants(&Image{}, "")
+	if b.process.Policy != nil {
+		e.AllowedCommands = b.process.Policy.AllowedCommands()
+		e.Policy = b.process.Policy
+	}
+
+	jsend.Wrap(w).Status(http.StatusOK).Data(LintScript(script.Script, &e)).Send()
+	return
+
+requestError:
+	b.respondErr(w, http.StatusBadRequest, err)
+	return
+}
+
 func (b *backend) versionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{ \"version\": \"" + b.options.Get("version", "unversioned") + "\" }"))
 }
@@ -387,7 +1245,13 @@ func StartWeb(o util.Options) (err error) {
 		return
 	}
 
-	back := &backend{o, db, imgdir, "/static"}
+	process, err := NewProcessConfig(o)
+	if err != nil {
+		return
+	}
+
+	trialdir := filepath.Join(os.TempDir(), "paperless-trials")
+	back := &backend{o, db, imgdir, "/static", trialdir, "/trial", process}
 
 	r := chi.NewRouter()
 
@@ -408,9 +1272,21 @@ func StartWeb(o util.Options) (err error) {
 				r.Get("/", back.singleImageHandler)
 				r.Put("/", back.singleImageHandler)
 				r.Delete("/", back.singleImageHandler)
+				r.Post("/process", back.imageProcessHandler)
+				r.Post("/rotate", back.imageRotateHandler)
+				r.Post("/reviewed", back.imageReviewedHandler)
+				r.Get("/related", back.imageRelatedHandler)
 			})
 		})
 
+		r.Get("/review", back.reviewHandler)
+		r.Get("/upcoming", back.upcomingHandler)
+		r.Get("/upcoming.ics", back.upcomingICSHandler)
+		r.Get("/duplicates", back.duplicatesHandler)
+		r.Route("/asn", func(r chi.Router) {
+			r.Get("/labels", back.asnLabelsHandler)
+			r.Get("/{asn}", back.asnHandler)
+		})
 		r.Route("/tag", func(r chi.Router) {
 			r.Get("/", back.tagHandler)
 			r.Post("/", back.tagHandler)
@@ -421,18 +1297,25 @@ func StartWeb(o util.Options) (err error) {
 			})
 		})
 		r.Route("/script", func(r chi.Router) {
-			r.Get("/", todoHandler)
-			r.Post("/", todoHandler)
+			r.Get("/", back.scriptHandler)
+			r.Post("/", back.scriptHandler)
+			r.Post("/lint", back.scriptLintHandler)
 			r.Route("/{scriptID}", func(r chi.Router) {
 				r.Use(back.loadScriptCtx)
-				r.Get("/", todoHandler)
-				r.Put("/", todoHandler)
-				r.Delete("/", todoHandler)
+				r.Get("/", back.singleScriptHandler)
+				r.Put("/", back.singleScriptHandler)
+				r.Delete("/", back.singleScriptHandler)
+				r.Get("/version", back.scriptVersionsHandler)
+				r.Get("/version/{version}", back.scriptVersionHandler)
+				r.Get("/diff", back.scriptDiffHandler)
+				r.Post("/rollback", back.scriptRollbackHandler)
+				r.Post("/trial", back.scriptTrialHandler)
 			})
 		})
 	})
 
 	FileServer(r, back.staticURL, http.Dir(imgdir))
+	FileServer(r, back.trialURL, http.Dir(trialdir))
 	FileServer(r, "/dist", _escDir(false, "/dist/"))
 
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
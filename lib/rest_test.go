@@ -0,0 +1,116 @@
+package paperless
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func Test_requestScriptEdit(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		wantErr     bool
+	}{
+		{"JSON text", "application/json", `{"Name": "a", "Script": "echo a\n"}`, "echo a\n", false},
+		{"JSON spec", "application/json",
+			`{"Name": "a", "Spec": {"Links": [{"Commands": [{"Argv": ["echo", "a"]}]}]}}`,
+			"echo a\n", false},
+		{"YAML spec", "application/yaml; charset=utf-8",
+			"Name: a\nSpec:\n  Links:\n  - Commands:\n    - Argv: [echo, a]\n      Redirect: $out\n",
+			"echo a > $out\n", false},
+		{"YAML unknown field", "application/x-yaml", "Name: a\nOther: b\n", "", true},
+		{"Both text and spec", "application/json",
+			`{"Script": "echo a", "Spec": {"Links": []}}`, "", true},
+		{"Invalid spec", "text/yaml", "Spec:\n  Links:\n  - Commands: []\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/script", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+
+			var e scriptEdit
+			err := requestScriptEdit(r, &e)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requestScriptEdit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && e.Script != tt.want {
+				t.Errorf("requestScriptEdit() script = %q, want %q", e.Script, tt.want)
+			}
+		})
+	}
+}
+
+func Test_respondScript(t *testing.T) {
+	b := &backend{}
+	s := Script{Id: 1, Name: "a", Script: "echo $input > $tmpA\n", Version: 2}
+
+	r := httptest.NewRequest("GET", "/api/v1/script/1", nil)
+	w := httptest.NewRecorder()
+	b.respondScript(w, r, http.StatusOK, s)
+
+	var resp struct {
+		Data restScript
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("Parsing the JSON response failed: %v", err)
+	}
+	if resp.Data.Spec == nil || resp.Data.Version != 2 ||
+		resp.Data.Spec.Links[0].Commands[0].Redirect != "$tmpA" {
+		t.Errorf("respondScript() JSON = %s", w.Body.String())
+	}
+
+	r.Header.Set("Accept", "application/yaml")
+	w = httptest.NewRecorder()
+	b.respondScript(w, r, http.StatusOK, s)
+	if w.Header().Get("Content-Type") != "application/yaml" {
+		t.Errorf("respondScript() Content-Type = %s", w.Header().Get("Content-Type"))
+	}
+
+	var got restScript
+	err = yaml.UnmarshalStrict(w.Body.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("Parsing the YAML response failed: %v", err)
+	}
+	script, err := got.Spec.Script()
+	if err != nil || script != s.Script || got.Name != "a" {
+		t.Errorf("respondScript() YAML = %s", w.Body.String())
+	}
+}
+
+func Test_wrapImage(t *testing.T) {
+	b := &backend{}
+	tests := []struct {
+		name     string
+		warnings string
+		want     string
+	}{
+		{"No warnings", "", `"Warnings":[]`},
+		{"Warnings", "Blank page\nBlurry", `"Warnings":["Blank page","Blurry"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(b.wrapImage(&Image{Id: 1, Warnings: tt.warnings}))
+			if err != nil {
+				t.Fatalf("Encoding the image failed: %v", err)
+			}
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("wrapImage() = %s, want %s", data, tt.want)
+			}
+
+			// The response can be sent back with PUT
+			var img Image
+			err = json.Unmarshal(data, &img)
+			if err != nil || img.Id != 1 {
+				t.Errorf("Decoding the image failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package paperless
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	util "github.com/kopoli/go-util"
+)
+
+// Sandbox restricts the external commands a Cmd runs. A sandboxed command
+// sees only the system directories read-only, the RootDir of the chain and
+// the files outside it that the Environment lists as Inputs (read-only) and
+// Outputs (writable). It has no network access. The built-in commands run
+// inside this process, so they check their files with Status.filePath.
+type Sandbox struct {
+	// CPUTime is the maximum CPU time of a command
+	CPUTime time.Duration
+
+	// Memory is the maximum size of the address space of a command in
+	// bytes
+	Memory uint64
+
+	// OutputSize is the maximum size of the files a command writes and of
+	// its standard output in bytes
+	OutputSize uint64
+}
+
+// limitWriter fails writes after limit bytes have been written
+type limitWriter struct {
+	w     io.Writer
+	limit uint64
+}
+
+func (l *limitWriter) Write(p []byte) (n int, err error) {
+	if uint64(len(p)) > l.limit {
+		n, _ = l.w.Write(p[:l.limit])
+		l.limit = 0
+		return n, util.E.New("Output size limit exceeded")
+	}
+	n, err = l.w.Write(p)
+	l.limit -= uint64(n)
+	return
+}
+
+// limitOutput limits the size of the command's standard output
+func (sb *Sandbox) limitOutput(w io.Writer) io.Writer {
+	if w == nil || sb.OutputSize == 0 {
+		return w
+	}
+	return &limitWriter{w, sb.OutputSize}
+}
+
+// inDir tells if the path is the directory or inside it
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// outsideFiles returns the files outside RootDir of the listed constants the
+// command refers to
+func (c *Cmd) outsideFiles(s *Status, names []string) (ret []string) {
+	used := map[string]bool{}
+	for _, a := range c.Cmd {
+		for _, name := range parseConsts(a) {
+			used[name] = true
+		}
+	}
+	for _, name := range names {
+		if !used[name] || s.Constants[name] == "" {
+			continue
+		}
+		path := PathAbs(s.RootDir, s.Constants[name])
+		if !inDir(s.RootDir, path) && !hasString(ret, path) {
+			ret = append(ret, path)
+		}
+	}
+	return
+}
+
+// readable returns the input files outside RootDir the command refers to
+func (c *Cmd) readable(s *Status) []string {
+	return c.outsideFiles(s, s.Inputs)
+}
+
+// writable returns the output files outside RootDir the command refers to.
+// The redirected output is opened outside the sandbox.
+func (c *Cmd) writable(s *Status) (ret []string) {
+	var names []string
+	for _, name := range s.Outputs {
+		if _, pos := getRedirectFile(">", c.Cmd); pos > 0 &&
+			hasString(parseConsts(c.Cmd[pos+1]), name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return c.outsideFiles(s, names)
+}
+
+// filePath returns the absolute path of a file argument of a built-in
+// command or a redirection. When sandboxed, the file has to be in RootDir or
+// one of the Outputs, or one of the Inputs if it is only read.
+func (s *Status) filePath(path string, write bool) (string, error) {
+	path = PathAbs(s.RootDir, path)
+	if s.Sandbox == nil || inDir(s.RootDir, path) {
+		return path, nil
+	}
+
+	names := s.Outputs
+	if !write {
+		names = append(append([]string{}, s.Inputs...), s.Outputs...)
+	}
+	for _, name := range names {
+		if s.Constants[name] != "" && PathAbs(s.RootDir, s.Constants[name]) == path {
+			return path, nil
+		}
+	}
+	return "", util.E.New("Access to the file %s is not allowed in the sandbox", path)
+}
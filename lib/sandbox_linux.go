@@ -0,0 +1,119 @@
+// +build linux
+
+package paperless
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	util "github.com/kopoli/go-util"
+)
+
+// validate makes sure the programs required for sandboxing are available
+func (sb *Sandbox) validate() (err error) {
+	for _, prog := range []string{"bwrap", "prlimit"} {
+		_, err = exec.LookPath(prog)
+		if err != nil {
+			return util.E.Annotate(err, "Sandboxing requires the program ", prog)
+		}
+	}
+	return
+}
+
+// The system directories the commands see read-only
+var sandboxSystemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc"}
+
+// command creates the command that runs args in the sandbox. The namespaces
+// and the filesystem view are set up with bubblewrap and the resource limits
+// with prlimit. The command is killed when the context is done.
+func (sb *Sandbox) command(ctx context.Context, rootdir string, readable, writable []string, args []string) (cmd *exec.Cmd, err error) {
+	err = sb.validate()
+	if err != nil {
+		return
+	}
+
+	for _, file := range writable {
+		// The file has to exist to be bound
+		var fp *os.File
+		fp, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			err = util.E.Annotate(err, "Could not create output file ", file)
+			return
+		}
+		fp.Close()
+	}
+
+	// A program outside the system directories is bound as well
+	if path, e2 := exec.LookPath(args[0]); e2 == nil {
+		if path, e2 = filepath.Abs(path); e2 == nil {
+			readable = append(readable, path)
+		}
+	}
+
+	wrap := sb.args(rootdir, readable, writable, args)
+	cmd = exec.CommandContext(ctx, wrap[0], wrap[1:]...)
+	cmd.Dir = rootdir
+	return
+}
+
+// args returns the bwrap and prlimit command line that runs args. Only the
+// system directories, the readable files and the writable rootdir and files
+// are visible.
+func (sb *Sandbox) args(rootdir string, readable, writable []string, args []string) []string {
+	wrap := []string{"bwrap"}
+	for _, dir := range sandboxSystemDirs {
+		wrap = append(wrap, "--ro-bind-try", dir, dir)
+	}
+	wrap = append(wrap,
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+		"--bind", rootdir, rootdir,
+	)
+
+	for _, file := range readable {
+		if !sandboxVisible(file, rootdir) {
+			wrap = append(wrap, "--ro-bind", file, file)
+		}
+	}
+	for _, file := range writable {
+		wrap = append(wrap, "--bind", file, file)
+	}
+
+	wrap = append(wrap,
+		"--unshare-all",
+		"--die-with-parent",
+		"--new-session",
+		"--chdir", rootdir,
+		"--",
+		"prlimit")
+
+	if sb.CPUTime > 0 {
+		wrap = append(wrap, fmt.Sprintf("--cpu=%d", (sb.CPUTime+time.Second-1)/time.Second))
+	}
+	if sb.Memory > 0 {
+		wrap = append(wrap, fmt.Sprintf("--as=%d", sb.Memory))
+	}
+	if sb.OutputSize > 0 {
+		wrap = append(wrap, fmt.Sprintf("--fsize=%d", sb.OutputSize))
+	}
+	wrap = append(wrap, "--")
+	return append(wrap, args...)
+}
+
+// sandboxVisible tells if the file is already visible in the sandbox
+func sandboxVisible(file, rootdir string) bool {
+	if inDir(rootdir, file) {
+		return true
+	}
+	for _, dir := range sandboxSystemDirs {
+		if inDir(dir, file) {
+			return true
+		}
+	}
+	return false
+}
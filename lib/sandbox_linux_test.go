@@ -0,0 +1,40 @@
+// +build linux
+
+package paperless
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandbox_args(t *testing.T) {
+	sb := &Sandbox{CPUTime: 1500 * time.Millisecond, Memory: 1000, OutputSize: 10}
+	got := sb.args("/tmp/chain",
+		[]string{"/images/orig.jpg", "/usr/bin/convert", "/tmp/chain/tmp1"},
+		[]string{"/images/clean.jpg"},
+		[]string{"convert", "/images/orig.jpg", "/images/clean.jpg"})
+
+	var want []string
+	for _, dir := range sandboxSystemDirs {
+		want = append(want, "--ro-bind-try", dir, dir)
+	}
+	want = append([]string{"bwrap"}, want...)
+	want = append(want, strings.Fields(
+		"--dev /dev --proc /proc --tmpfs /tmp --bind /tmp/chain /tmp/chain "+
+			"--ro-bind /images/orig.jpg /images/orig.jpg "+
+			"--bind /images/clean.jpg /images/clean.jpg "+
+			"--unshare-all --die-with-parent --new-session --chdir /tmp/chain -- "+
+			"prlimit --cpu=2 --as=1000 --fsize=10 -- "+
+			"convert /images/orig.jpg /images/clean.jpg")...)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sandbox.args() = %v\nwant %v", got, want)
+	}
+	for i := range got {
+		if got[i] == "/" {
+			t.Errorf("Sandbox.args() binds the root directory: %v", got)
+		}
+	}
+}
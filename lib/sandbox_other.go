@@ -0,0 +1,18 @@
+// +build !linux
+
+package paperless
+
+import (
+	"context"
+	"os/exec"
+
+	util "github.com/kopoli/go-util"
+)
+
+func (sb *Sandbox) validate() error {
+	return util.E.New("Sandboxing is supported only on Linux")
+}
+
+func (sb *Sandbox) command(ctx context.Context, rootdir string, readable, writable []string, args []string) (*exec.Cmd, error) {
+	return nil, sb.validate()
+}
@@ -0,0 +1,115 @@
+package paperless
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_limitWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sb := &Sandbox{OutputSize: 5}
+	w := sb.limitOutput(buf)
+
+	n, err := w.Write([]byte("abc"))
+	if n != 3 || err != nil {
+		t.Errorf("Write() = %d, %v, want 3, nil", n, err)
+	}
+	n, err = w.Write([]byte("defg"))
+	if n != 2 || err == nil {
+		t.Errorf("Write() = %d, %v, want 2 and an error", n, err)
+	}
+	if buf.String() != "abcde" {
+		t.Errorf("Written data = %s, want abcde", buf.String())
+	}
+}
+
+func sandboxStatus() *Status {
+	s := &Status{}
+	s.RootDir = "/tmp/chain"
+	s.Constants = map[string]string{
+		"input":  "/images/orig.jpg",
+		"output": "/images/clean.jpg",
+		"tmpA":   "/tmp/chain/tmp1",
+	}
+	s.Inputs = []string{"input"}
+	s.Outputs = []string{"output"}
+	return s
+}
+
+func TestCmd_writable(t *testing.T) {
+	s := sandboxStatus()
+
+	tests := []struct {
+		name string
+		cmd  []string
+		want []string
+	}{
+		{"No constants", []string{"true"}, nil},
+		{"Output outside the root", []string{"convert", "$input", "$output"},
+			[]string{"/images/clean.jpg"}},
+		{"Output in the root", []string{"convert", "$input", "pnm:$tmpA"}, nil},
+		{"Redirected output", []string{"cat", "$input", ">", "$output"}, nil},
+		{"Only input", []string{"file", "$input"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cmd{tt.cmd}
+			compare(t, "Cmd.writable() not expected", tt.want, c.writable(s))
+		})
+	}
+}
+
+func TestCmd_readable(t *testing.T) {
+	s := sandboxStatus()
+
+	tests := []struct {
+		name string
+		cmd  []string
+		want []string
+	}{
+		{"No constants", []string{"true"}, nil},
+		{"Input", []string{"file", "$input"}, []string{"/images/orig.jpg"}},
+		{"Output only", []string{"convert", "$tmpA", "$output"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cmd{tt.cmd}
+			compare(t, "Cmd.readable() not expected", tt.want, c.readable(s))
+		})
+	}
+}
+
+func TestStatus_filePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		sandbox bool
+		path    string
+		write   bool
+		want    string
+		wantErr bool
+	}{
+		{"Not sandboxed", false, "/etc/passwd", true, "/etc/passwd", false},
+		{"Relative in the root", true, "tmp2", true, "/tmp/chain/tmp2", false},
+		{"Outside the root", true, "/etc/passwd", false, "", true},
+		{"Escaping the root", true, "../other/file", true, "", true},
+		{"Reading the input", true, "/images/orig.jpg", false, "/images/orig.jpg", false},
+		{"Writing the input", true, "/images/orig.jpg", true, "", true},
+		{"Writing the output", true, "/images/clean.jpg", true, "/images/clean.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := sandboxStatus()
+			if tt.sandbox {
+				s.Sandbox = &Sandbox{}
+			}
+			got, err := s.filePath(tt.path, tt.write)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Status.filePath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Status.filePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,14 @@ package paperless
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
+
+	util "github.com/kopoli/go-util"
 )
 
 type TokenType int
@@ -227,3 +232,84 @@ func (l *lexer) run() {
 	}
 	close(l.tokens)
 }
+
+/// Search qualifiers
+
+// searchQualifiers set the fields of the Search from the name:value terms
+// of a query
+var searchQualifiers = map[string]func(s *Search, value string) error{
+	"lang": func(s *Search, value string) error {
+		s.Language = value
+		return nil
+	},
+
+	// is:unpaid
+	"is": func(s *Search, value string) error {
+		if value != "unpaid" {
+			return util.E.New("Unknown state %s", value)
+		}
+		s.Unpaid = true
+		return nil
+	},
+
+	// asn:42
+	"asn": func(s *Search, value string) (err error) {
+		s.ASN, err = strconv.Atoi(value)
+		if err != nil || s.ASN <= 0 {
+			return util.E.New("Expected a positive number")
+		}
+		return
+	},
+
+	// like:42
+	"like": func(s *Search, value string) (err error) {
+		s.Like, err = strconv.Atoi(value)
+		if err != nil || s.Like <= 0 {
+			return util.E.New("Expected an image id")
+		}
+		return
+	},
+
+	// due:YYYY-MM or due:YYYY-MM-DD
+	"due": func(s *Search, value string) (err error) {
+		if len(value) == len("2006-01") {
+			s.DueFrom, err = time.Parse("2006-01", value)
+			s.DueTo = s.DueFrom.AddDate(0, 1, 0)
+		} else {
+			s.DueFrom, err = time.Parse("2006-01-02", value)
+			s.DueTo = s.DueFrom.AddDate(0, 0, 1)
+		}
+		if err != nil {
+			return util.E.New("Expected YYYY-MM or YYYY-MM-DD")
+		}
+		return
+	},
+}
+
+var qualifierRe = regexp.MustCompile(`(^|\s)(\w+):(\S+)`)
+
+// ParseSearch creates a Search from the query. The known name:value
+// qualifiers, e.g. lang:sv, are matched against the fields of the images
+// and the rest of the query against their text.
+func ParseSearch(query string) (ret Search, err error) {
+	match := &strings.Builder{}
+	last := 0
+	for _, m := range qualifierRe.FindAllStringSubmatchIndex(query, -1) {
+		name, value := query[m[4]:m[5]], query[m[6]:m[7]]
+		set, ok := searchQualifiers[name]
+		if !ok {
+			continue
+		}
+		err = set(&ret, value)
+		if err != nil {
+			err = util.E.Annotate(err, "Invalid search qualifier ", name)
+			return
+		}
+		match.WriteString(query[last:m[0]])
+		match.WriteString(" ")
+		last = m[1]
+	}
+	match.WriteString(query[last:])
+	ret.Match = strings.Join(strings.Fields(match.String()), " ")
+	return
+}
@@ -1,7 +1,9 @@
 package paperless
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -78,3 +80,44 @@ func Test_lexer_Init(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  Search
+	}{
+		{"Text", "some text", Search{Match: "some text"}},
+		{"Language", "lang:sv faktura", Search{Match: "faktura", Language: "sv"}},
+		{"Language in the middle", "first lang:en second", Search{Match: "first second", Language: "en"}},
+		{"Unknown qualifier", "text:word lang:fi", Search{Match: "text:word", Language: "fi"}},
+		{"Not a qualifier", "a:", Search{Match: "a:"}},
+		{"Unpaid bills due in a month", "is:unpaid due:2026-10", Search{Unpaid: true,
+			DueFrom: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			DueTo:   time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}},
+		{"Due on a day", "due:2026-10-31", Search{
+			DueFrom: time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC),
+			DueTo:   time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)}},
+		{"Archive serial number", "asn:42", Search{ASN: 42}},
+		{"Related", "like:7 lasku", Search{Match: "lasku", Like: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSearch(tt.query)
+			if err != nil {
+				t.Fatalf("ParseSearch() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSearch() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSearch_invalid(t *testing.T) {
+	for _, query := range []string{"is:paid", "due:October", "due:2026-13", "asn:0", "asn:x", "like:x"} {
+		if _, err := ParseSearch(query); err == nil {
+			t.Errorf("ParseSearch(%q) should fail", query)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package paperless
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
@@ -14,6 +17,9 @@ import (
 type db struct {
 	file string
 	*sqlx.DB
+
+	// related caches the statistics of the related images
+	related relatedCache
 }
 
 type dbTx struct {
@@ -51,6 +57,40 @@ type Search struct {
 	OrderBy string
 	Match   string
 	Tag     string
+
+	// Script and ScriptVersion match the script that processed the image
+	Script        string
+	ScriptVersion int
+
+	// Review matches the images that need a review
+	Review bool
+
+	// Language matches the detected language of the text
+	Language string
+
+	// Unpaid matches the bills that are not paid
+	Unpaid bool
+
+	// NotPaid excludes the images that are marked paid
+	NotPaid bool
+
+	// Document matches the pages of a batch document
+	Document int
+
+	// ASN matches the archive serial number
+	ASN int
+
+	// Like matches the images related to the image with the id and orders
+	// them by the relevance
+	Like int
+
+	// Due matches the images that have a due date
+	Due bool
+
+	// DueFrom and DueTo match the bills due on or after DueFrom and before
+	// DueTo. They are at midnight UTC.
+	DueFrom time.Time
+	DueTo   time.Time
 }
 
 func openDbFile(dbfile string) (ret *db, err error) {
@@ -87,7 +127,8 @@ func openDbFile(dbfile string) (ret *db, err error) {
 CREATE TABLE IF NOT EXISTS tag (
   id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
   name TEXT DEFAULT "" NOT NULL UNIQUE ON CONFLICT ABORT,
-  comment TEXT DEFAULT ""
+  comment TEXT DEFAULT "",
+  params TEXT DEFAULT ""                        -- default script parameters
 );
 
 -- The image data
@@ -101,7 +142,44 @@ CREATE TABLE IF NOT EXISTS image (
   interpretdate DATETIME,                       -- timestamp when it was interpret
 
   processlog TEXT DEFAULT "",                   -- Log of processing
-  filename TEXT DEFAULT ""                     -- The original filename
+  filename TEXT DEFAULT "",                     -- The original filename
+  params TEXT DEFAULT "",                       -- script parameters
+  scriptname TEXT DEFAULT "",                   -- script that processed the image
+  scriptversion INTEGER DEFAULT 0,              --   and its version
+  orientation INTEGER DEFAULT 0,                -- detected clockwise rotation in degrees
+  writingscript TEXT DEFAULT "",                -- detected writing script
+  confidence REAL DEFAULT 0,                    -- mean OCR confidence of the words
+  minconfidence REAL DEFAULT 0,                 --   and the minimum
+  needsreview BOOLEAN DEFAULT 0,                -- the text needs to be checked
+  language TEXT DEFAULT "",                     -- detected language of the text
+  documentdate DATETIME,                        -- date of the document
+  datesource TEXT DEFAULT "",                   --   and where it is from
+
+  iban TEXT DEFAULT "",                         -- payment details of a bill
+  reference TEXT DEFAULT "",
+  creditorreference TEXT DEFAULT "",
+  duedate DATETIME,
+  amount INTEGER DEFAULT 0,                     --   in cents
+  paid BOOLEAN DEFAULT 0,
+  duesource TEXT DEFAULT "",                    -- where the due date is from
+  reminddays INTEGER DEFAULT 0,                 -- days to remind before the due date
+  barcodes TEXT DEFAULT "",                     -- decoded barcodes one per line
+  asn INTEGER DEFAULT 0,                        -- archive serial number
+  document INTEGER DEFAULT 0,                   -- first page of the batch document
+  phash TEXT DEFAULT "",                        -- perceptual hash in hex
+  warnings TEXT DEFAULT "",                     -- upload warnings one per line
+  rotation INTEGER DEFAULT 0                    -- clockwise rotation given by hand
+);
+
+-- The archive serial numbers are unique when they are set
+CREATE UNIQUE INDEX IF NOT EXISTS image_asn ON image(asn) WHERE asn != 0;
+
+-- The archive serial numbers printed as labels
+CREATE TABLE IF NOT EXISTS asnlabel (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  first INTEGER NOT NULL,
+  last INTEGER NOT NULL,
+  date DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE VIRTUAL TABLE IF NOT EXISTS imgtext USING fts4 (
@@ -120,7 +198,20 @@ CREATE TABLE IF NOT EXISTS imgtag (
 CREATE TABLE IF NOT EXISTS script (
   id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
   name TEXT UNIQUE ON CONFLICT ABORT,
-  script TEXT DEFAULT ""
+  script TEXT DEFAULT "",
+  version INTEGER DEFAULT 0                     -- the current version
+);
+
+-- Every version of the scripts
+CREATE TABLE IF NOT EXISTS scriptversion (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  scriptid INTEGER REFERENCES script(id) NOT NULL,
+  version INTEGER NOT NULL,
+  script TEXT DEFAULT "",
+  author TEXT DEFAULT "",
+  message TEXT DEFAULT "",
+  date DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scriptid, version)
 );
 
 `)
@@ -128,6 +219,15 @@ CREATE TABLE IF NOT EXISTS script (
 			goto initfail
 		}
 
+		_, err = d.Exec(fmt.Sprintf("PRAGMA user_version=%d", len(dbMigrations)))
+		if err != nil {
+			goto initfail
+		}
+	} else {
+		err = migrateDb(d)
+		if err != nil {
+			goto initfail
+		}
 	}
 	_, err = d.Exec("PRAGMA busy_timeout=10000")
 	if err != nil {
@@ -137,7 +237,7 @@ CREATE TABLE IF NOT EXISTS script (
 	// Work around the multiple access problems
 	d.SetMaxOpenConns(1)
 
-	ret = &db{dbfile, d}
+	ret = &db{file: dbfile, DB: d}
 	return
 
 initfail:
@@ -147,11 +247,148 @@ initfail:
 	return
 }
 
+// dbMigrations update the schema of an existing database. The user_version
+// of the database is the number of the migrations applied to it and a new
+// database is created with the latest schema. The dates of the existing
+// images are set to the zero time that the new images get.
+var dbMigrations = []string{
+	// The script parameters
+	`
+ALTER TABLE tag ADD COLUMN params TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN params TEXT DEFAULT "";
+`,
+	// The versions of the scripts. The current scripts become the first
+	// versions.
+	`
+ALTER TABLE image ADD COLUMN scriptname TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN scriptversion INTEGER DEFAULT 0;
+ALTER TABLE script ADD COLUMN version INTEGER DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS scriptversion (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  scriptid INTEGER REFERENCES script(id) NOT NULL,
+  version INTEGER NOT NULL,
+  script TEXT DEFAULT "",
+  author TEXT DEFAULT "",
+  message TEXT DEFAULT "",
+  date DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scriptid, version)
+);
+
+INSERT INTO scriptversion(scriptid, version, script, message)
+  SELECT id, 1, script, "Initial version" FROM script;
+UPDATE script SET version = 1;
+`,
+	// The orientation of the page
+	`
+ALTER TABLE image ADD COLUMN orientation INTEGER DEFAULT 0;
+ALTER TABLE image ADD COLUMN writingscript TEXT DEFAULT "";
+`,
+	// The OCR confidence
+	`
+ALTER TABLE image ADD COLUMN confidence REAL DEFAULT 0;
+ALTER TABLE image ADD COLUMN minconfidence REAL DEFAULT 0;
+ALTER TABLE image ADD COLUMN needsreview BOOLEAN DEFAULT 0;
+`,
+	// The language of the text
+	`
+ALTER TABLE image ADD COLUMN language TEXT DEFAULT "";
+`,
+	// The date of the document
+	`
+ALTER TABLE image ADD COLUMN documentdate DATETIME;
+UPDATE image SET documentdate = "0001-01-01 00:00:00+00:00";
+ALTER TABLE image ADD COLUMN datesource TEXT DEFAULT "";
+`,
+	// The payment details of the bills
+	`
+ALTER TABLE image ADD COLUMN iban TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN reference TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN creditorreference TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN duedate DATETIME;
+UPDATE image SET duedate = "0001-01-01 00:00:00+00:00";
+ALTER TABLE image ADD COLUMN amount INTEGER DEFAULT 0;
+ALTER TABLE image ADD COLUMN paid BOOLEAN DEFAULT 0;
+`,
+	// The reminders
+	`
+ALTER TABLE image ADD COLUMN duesource TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN reminddays INTEGER DEFAULT 0;
+`,
+	// The barcodes and the batch documents
+	`
+ALTER TABLE image ADD COLUMN barcodes TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN asn INTEGER DEFAULT 0;
+ALTER TABLE image ADD COLUMN document INTEGER DEFAULT 0;
+`,
+	// The unique archive serial numbers
+	`
+CREATE UNIQUE INDEX IF NOT EXISTS image_asn ON image(asn) WHERE asn != 0;
+`,
+	// The duplicate detection and the upload warnings
+	`
+ALTER TABLE image ADD COLUMN phash TEXT DEFAULT "";
+ALTER TABLE image ADD COLUMN warnings TEXT DEFAULT "";
+`,
+	// The manual rotation
+	`
+ALTER TABLE image ADD COLUMN rotation INTEGER DEFAULT 0;
+`,
+	// The printed archive serial number labels
+	`
+-- The archive serial numbers printed as labels
+CREATE TABLE IF NOT EXISTS asnlabel (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  first INTEGER NOT NULL,
+  last INTEGER NOT NULL,
+  date DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`,
+}
+
+// migrateDb applies the migrations the database does not have yet
+func migrateDb(d *sqlx.DB) (err error) {
+	var version int
+	err = d.Get(&version, "PRAGMA user_version")
+	if err != nil {
+		return
+	}
+	if version > len(dbMigrations) {
+		return util.E.New("The database version %d is newer than the supported %d",
+			version, len(dbMigrations))
+	}
+
+	for ; version < len(dbMigrations); version++ {
+		tx, err := d.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(dbMigrations[version])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version=%d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return util.E.Annotate(err, "Migrating the database to version ", version+1, " failed")
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
 func (db *db) getTag(id int) (ret Tag, err error) {
 	err = db.Get(&ret, "SELECT * from tag WHERE id = $1", id)
 	return
 }
 
+func (db *db) getTagByName(name string) (ret Tag, err error) {
+	err = db.Get(&ret, "SELECT * from tag WHERE name = $1", name)
+	return
+}
+
 func (db *db) getScript(id int) (ret Script, err error) {
 	err = db.Get(&ret, "SELECT * from script WHERE id = $1", id)
 	return
@@ -180,6 +417,66 @@ func (db *db) getImage(id int) (ret Image, err error) {
 	return
 }
 
+// getImageByASN returns the image with the archive serial number. The error
+// is sql.ErrNoRows if no image has the number.
+func (db *db) getImageByASN(asn int) (ret Image, err error) {
+	if asn <= 0 {
+		err = util.E.New("Invalid archive serial number %d", asn)
+		return
+	}
+
+	imgs, err := db.getImages(nil, &Search{ASN: asn})
+	if err != nil {
+		return
+	}
+	if len(imgs.Images) == 0 {
+		err = sql.ErrNoRows
+		return
+	}
+	ret = imgs.Images[0]
+	return
+}
+
+// nextASNQuery selects the archive serial number after the largest one in
+// use or printed as a label
+const nextASNQuery = `SELECT MAX(IFNULL((SELECT MAX(asn) FROM image), 0),
+                                  IFNULL((SELECT MAX(last) FROM asnlabel), 0)) + 1`
+
+// nextASN returns the archive serial number after the largest one in use or
+// printed as a label
+func (db *db) nextASN() (ret int, err error) {
+	err = db.Get(&ret, nextASNQuery)
+	return
+}
+
+// reserveASNs reserves the count next archive serial numbers for printed
+// labels, so they are not assigned to the images automatically. The first
+// reserved number is returned.
+func (db *db) reserveASNs(count int) (ret int, err error) {
+	err = withTx(db, func(tx *sqlx.Tx) (err error) {
+		err = tx.Get(&ret, nextASNQuery)
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec("INSERT INTO asnlabel(first, last) VALUES($1, $2)", ret, ret+count-1)
+		return
+	})
+	return
+}
+
+// assignASN assigns the next archive serial number to the image. The
+// numbers reserved for the printed labels are not assigned.
+func (db *db) assignASN(img *Image) (err error) {
+	err = withTx(db, func(tx *sqlx.Tx) (err error) {
+		_, err = tx.Exec("UPDATE image SET asn = ("+nextASNQuery+") WHERE id = $1", img.Id)
+		if err != nil {
+			return
+		}
+		return tx.Get(&img.ASN, "SELECT asn FROM image WHERE id = $1", img.Id)
+	})
+	return
+}
+
 func (db *db) getTags(p *Page) (ret []Tag, err error) {
 	query := "SELECT * from tag"
 	order := " ORDER BY name ASC"
@@ -199,7 +496,7 @@ func (db *db) getTags(p *Page) (ret []Tag, err error) {
 }
 
 func (db *db) addTag(t Tag) (ret Tag, err error) {
-	_, err = db.Exec("INSERT INTO tag(name, comment) VALUES($1, $2)", t.Name, t.Comment)
+	_, err = db.Exec("INSERT INTO tag(name, comment, params) VALUES($1, $2, $3)", t.Name, t.Comment, t.Params)
 	if err != nil {
 		return
 	}
@@ -209,12 +506,15 @@ func (db *db) addTag(t Tag) (ret Tag, err error) {
 }
 
 func (db *db) updateTag(t Tag) (err error) {
-	_, err = db.Exec("UPDATE tag SET comment = $1 WHERE name = $2", t.Comment, t.Name)
+	_, err = db.Exec("UPDATE tag SET comment = $1, params = $2 WHERE name = $3", t.Comment, t.Params, t.Name)
 	return
 }
 
 func (db *db) deleteTag(t Tag) (err error) {
 	_, err = db.Exec("DELETE FROM tag WHERE name = $1", t.Name)
+	if err == nil {
+		db.invalidateRelated()
+	}
 	return
 }
 
@@ -236,8 +536,37 @@ func (db *db) getScripts(p *Page) (ret []Script, err error) {
 	return
 }
 
-func (db *db) addScript(s Script) (ret Script, err error) {
-	_, err = db.Exec("INSERT INTO script(name, script) VALUES($1, $2)", s.Name, s.Script)
+func (db *db) getScriptByName(name string) (ret Script, err error) {
+	err = db.Get(&ret, "SELECT * from script WHERE name = $1", name)
+	return
+}
+
+// addScriptVersion stores the script's text as its next version
+func addScriptVersion(tx *sqlx.Tx, name, script, author, message string) (err error) {
+	var s Script
+	err = tx.Get(&s, "SELECT * FROM script WHERE name = $1", name)
+	if err != nil {
+		return
+	}
+
+	s.Version++
+	_, err = tx.Exec(`INSERT INTO scriptversion(scriptid, version, script, author, message, date)
+                          VALUES($1, $2, $3, $4, $5, $6)`, s.Id, s.Version, script, author, message, time.Now())
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec("UPDATE script SET script = $1, version = $2 WHERE id = $3", script, s.Version, s.Id)
+	return
+}
+
+func (db *db) addScript(s Script, author, message string) (ret Script, err error) {
+	err = withTx(db, func(tx *sqlx.Tx) (err error) {
+		_, err = tx.Exec("INSERT INTO script(name) VALUES($1)", s.Name)
+		if err != nil {
+			return
+		}
+		return addScriptVersion(tx, s.Name, s.Script, author, message)
+	})
 	if err != nil {
 		return
 	}
@@ -246,13 +575,48 @@ func (db *db) addScript(s Script) (ret Script, err error) {
 	return
 }
 
-func (db *db) updateScript(s Script) (err error) {
-	_, err = db.Exec("UPDATE script SET script = $1 WHERE name = $2", s.Script, s.Name)
+// updateScript stores the script as a new version
+func (db *db) updateScript(s Script, author, message string) (err error) {
+	err = withTx(db, func(tx *sqlx.Tx) error {
+		return addScriptVersion(tx, s.Name, s.Script, author, message)
+	})
+	return
+}
+
+// rollbackScript stores the given earlier version of the script as its new
+// version
+func (db *db) rollbackScript(s Script, version int, author string) (err error) {
+	v, err := db.getScriptVersion(s.Id, version)
+	if err != nil {
+		return
+	}
+	s.Script = v.Script
+	return db.updateScript(s, author, fmt.Sprintf("Rollback to version %d", version))
+}
+
+func (db *db) getScriptVersion(scriptid, version int) (ret ScriptVersion, err error) {
+	err = db.Get(&ret, "SELECT * FROM scriptversion WHERE scriptid = $1 AND version = $2",
+		scriptid, version)
+	return
+}
+
+// getScriptVersions returns the versions of the script, the latest first
+func (db *db) getScriptVersions(scriptid int) (ret []ScriptVersion, err error) {
+	err = db.Select(&ret, "SELECT * FROM scriptversion WHERE scriptid = $1 ORDER BY version DESC",
+		scriptid)
 	return
 }
 
 func (db *db) deleteScript(s Script) (err error) {
-	_, err = db.Exec("DELETE FROM script WHERE name = $1", s.Name)
+	err = withTx(db, func(tx *sqlx.Tx) (err error) {
+		_, err = tx.Exec(`DELETE FROM scriptversion WHERE scriptid IN
+                                  (SELECT id FROM script WHERE name = $1)`, s.Name)
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec("DELETE FROM script WHERE name = $1", s.Name)
+		return
+	})
 	return
 }
 
@@ -289,6 +653,48 @@ func (db *db) getImages(p *Page, s *Search) (ret ImageResult, err error) {
 			where = where + " AND imgtext.text MATCH :match"
 			args["match"] = s.Match
 		}
+		if s.Script != "" {
+			where = where + " AND image.scriptname = :script"
+			args["script"] = s.Script
+		}
+		if s.ScriptVersion != 0 {
+			where = where + " AND image.scriptversion = :scriptversion"
+			args["scriptversion"] = s.ScriptVersion
+		}
+		if s.Review {
+			where = where + " AND image.needsreview"
+		}
+		if s.Unpaid {
+			where = where + ` AND NOT image.paid AND
+                   (image.iban != "" OR image.reference != "" OR image.creditorreference != "")`
+		}
+		if s.ASN != 0 {
+			where = where + " AND image.asn = :asn"
+			args["asn"] = s.ASN
+		}
+		if s.Document != 0 {
+			where = where + " AND image.document = :document"
+			args["document"] = s.Document
+		}
+		if s.NotPaid {
+			where = where + " AND NOT image.paid"
+		}
+		if s.Due {
+			where = where + " AND image.duedate > :nodue"
+			args["nodue"] = time.Time{}
+		}
+		if !s.DueFrom.IsZero() {
+			where = where + " AND image.duedate >= :duefrom"
+			args["duefrom"] = s.DueFrom
+		}
+		if !s.DueTo.IsZero() {
+			where = where + " AND image.duedate < :dueto"
+			args["dueto"] = s.DueTo
+		}
+		if s.Language != "" {
+			where = where + " AND image.language = :language"
+			args["language"] = s.Language
+		}
 		if s.Tag != "" {
 			query = query + ", tag, imgtag"
 			where = where + " AND tag.name = :tag AND imgtag.tagid = tag.id AND imgtag.imgid = image.id"
@@ -315,6 +721,13 @@ func (db *db) getImages(p *Page, s *Search) (ret ImageResult, err error) {
 	}
 	nstmt.Close()
 
+	if s != nil && s.Like != 0 {
+		ids, err = db.rankRelated(s.Like, ids)
+		if err != nil {
+			return
+		}
+	}
+
 	ret.ResultCount = len(ids)
 
 	// No images found
@@ -368,9 +781,20 @@ func (db *db) getImages(p *Page, s *Search) (ret ImageResult, err error) {
 		return
 	}
 
+	// Keep the order of the ranking
+	if s != nil && s.Like != 0 {
+		pos := make(map[int]int, len(ids))
+		for i, id := range ids {
+			pos[id] = i
+		}
+		sort.Slice(ret.Images, func(i, j int) bool {
+			return pos[ret.Images[i].Id] < pos[ret.Images[j].Id]
+		})
+	}
+
 	err = withTx(db, func(tx *sqlx.Tx) (err error) {
 		for i := range ret.Images {
-			err = tx.Select(&ret.Images[i].Tags, `SELECT tag.id, tag.name, tag.comment FROM tag, imgtag
+			err = tx.Select(&ret.Images[i].Tags, `SELECT tag.id, tag.name, tag.comment, tag.params FROM tag, imgtag
                                                        WHERE imgtag.tagid = tag.id AND imgtag.imgid = $1 `, ret.Images[i].Id)
 			if err != nil {
 				return
@@ -399,8 +823,8 @@ func syncTagsToImage(tx *sqlx.Tx, i Image) (err error) {
 func (db *db) addImage(i Image) (ret Image, err error) {
 	err = withTx(db, func(tx *sqlx.Tx) (err error) {
 		_, err = tx.NamedExec(`INSERT INTO
-                   image(  checksum,  fileid,  scandate,  adddate,  interpretdate,  processlog,  filename)
-                   VALUES(:checksum, :fileid, :scandate, :adddate, :interpretdate, :processlog, :filename)`, i)
+                   image(  checksum,  fileid,  scandate,  adddate,  interpretdate,  processlog,  filename,  params,  scriptname,  scriptversion,  orientation,  writingscript,  confidence,  minconfidence,  needsreview,  language,  documentdate,  datesource,  iban,  reference,  creditorreference,  duedate,  amount,  paid,  duesource,  reminddays,  barcodes,  asn,  document,  phash,  warnings,  rotation)
+                   VALUES(:checksum, :fileid, :scandate, :adddate, :interpretdate, :processlog, :filename, :params, :scriptname, :scriptversion, :orientation, :writingscript, :confidence, :minconfidence, :needsreview, :language, :documentdate, :datesource, :iban, :reference, :creditorreference, :duedate, :amount, :paid, :duesource, :reminddays, :barcodes, :asn, :document, :phash, :warnings, :rotation)`, i)
 		if err != nil {
 			return
 		}
@@ -421,6 +845,9 @@ func (db *db) addImage(i Image) (ret Image, err error) {
 		ret = i
 		return
 	})
+	if err == nil {
+		db.invalidateRelated()
+	}
 	return
 }
 
@@ -428,7 +855,32 @@ func (db *db) updateImage(i Image) (err error) {
 	err = withTx(db, func(tx *sqlx.Tx) (err error) {
 		_, err = tx.NamedExec(`UPDATE image SET
                       interpretdate = :interpretdate,
-                      processlog = :processlog
+                      processlog = :processlog,
+                      params = :params,
+                      scriptname = :scriptname,
+                      scriptversion = :scriptversion,
+                      orientation = :orientation,
+                      writingscript = :writingscript,
+                      confidence = :confidence,
+                      minconfidence = :minconfidence,
+                      needsreview = :needsreview,
+                      language = :language,
+                      documentdate = :documentdate,
+                      datesource = :datesource,
+                      iban = :iban,
+                      reference = :reference,
+                      creditorreference = :creditorreference,
+                      duedate = :duedate,
+                      amount = :amount,
+                      paid = :paid,
+                      duesource = :duesource,
+                      reminddays = :reminddays,
+                      barcodes = :barcodes,
+                      asn = :asn,
+                      document = :document,
+                      phash = :phash,
+                      warnings = :warnings,
+                      rotation = :rotation
                       WHERE image.id = :id`, i)
 		if err != nil {
 			return
@@ -445,6 +897,9 @@ func (db *db) updateImage(i Image) (err error) {
 		err = syncTagsToImage(tx, i)
 		return
 	})
+	if err == nil {
+		db.invalidateRelated()
+	}
 	return
 }
 
@@ -463,5 +918,8 @@ func (db *db) deleteImage(s Image) (err error) {
 		_, err = tx.Exec(`DELETE FROM image WHERE image.checksum = $1`, s.Checksum)
 		return
 	})
+	if err == nil {
+		db.invalidateRelated()
+	}
 	return
 }
@@ -1,11 +1,15 @@
 package paperless
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -165,7 +169,7 @@ func Test_db_Tag(t *testing.T) {
 func Test_db_Script(t *testing.T) {
 	at := func(name, script string) testFunc {
 		return func(d *db) error {
-			_, err := d.addScript(Script{Name: name, Script: script})
+			_, err := d.addScript(Script{Name: name, Script: script}, "", "")
 			return err
 		}
 	}
@@ -178,7 +182,17 @@ func Test_db_Script(t *testing.T) {
 
 	ut := func(name, script string) testFunc {
 		return func(d *db) error {
-			return d.updateScript(Script{Name: name, Script: script})
+			return d.updateScript(Script{Name: name, Script: script}, "", "")
+		}
+	}
+
+	rt := func(id, version int) testFunc {
+		return func(d *db) error {
+			s, err := d.getScript(id)
+			if err != nil {
+				return err
+			}
+			return d.rollbackScript(s, version, "")
 		}
 	}
 
@@ -189,23 +203,29 @@ func Test_db_Script(t *testing.T) {
 		paging      *Page
 		wantScripts []Script
 	}{
-		{"Add empty script", []testOp{at("", "")}, false, nil, []Script{Script{Id: 1}}},
-		{"Add script with contents", []testOp{at("name", "")}, false, nil, []Script{Script{Id: 1, Name: "name"}}},
+		{"Add empty script", []testOp{at("", "")}, false, nil, []Script{Script{Id: 1, Version: 1}}},
+		{"Add script with contents", []testOp{at("name", "")}, false, nil, []Script{Script{Id: 1, Name: "name", Version: 1}}},
 		{"Add script and remove it", []testOp{
 			at("name", ""), at("abc", ""), dt("name"),
-		}, false, nil, []Script{Script{Id: 2, Name: "abc"}}},
+		}, false, nil, []Script{Script{Id: 2, Name: "abc", Version: 1}}},
 		{"Add script and update it", []testOp{
 			at("name", ""), ut("name", "script"),
-		}, false, nil, []Script{Script{Id: 1, Name: "name", Script: "script"}}},
+		}, false, nil, []Script{Script{Id: 1, Name: "name", Script: "script", Version: 2}}},
 		{"Update a script", []testOp{
 			at("name", "script"), ut("name", "toinen"),
-		}, false, nil, []Script{Script{Id: 1, Name: "name", Script: "toinen"}}},
+		}, false, nil, []Script{Script{Id: 1, Name: "name", Script: "toinen", Version: 2}}},
+		{"Roll back a script", []testOp{
+			at("name", "script"), ut("name", "toinen"), rt(1, 1),
+		}, false, nil, []Script{Script{Id: 1, Name: "name", Script: "script", Version: 3}}},
+		{"Roll back to a missing version", []testOp{
+			at("name", "script"), rt(1, 2),
+		}, true, nil, []Script{Script{Id: 1, Name: "name", Script: "script", Version: 1}}},
 		{"Add duplicate", []testOp{
 			at("name", ""), at("name", "other"),
-		}, true, nil, []Script{Script{Id: 1, Name: "name"}}},
+		}, true, nil, []Script{Script{Id: 1, Name: "name", Version: 1}}},
 		{"Pagination", []testOp{
 			at("f1", ""), at("f2", ""), at("f3", ""), at("f4", ""),
-		}, false, &Page{SinceId: 2, Count: 5}, []Script{Script{Id: 3, Name: "f3"}, Script{Id: 4, Name: "f4"}}},
+		}, false, &Page{SinceId: 2, Count: 5}, []Script{Script{Id: 3, Name: "f3", Version: 1}, Script{Id: 4, Name: "f4", Version: 1}}},
 	}
 	for _, tt := range tests {
 		db, err := setupDb()
@@ -251,6 +271,51 @@ func Test_db_Script(t *testing.T) {
 	}
 }
 
+func Test_db_ScriptVersions(t *testing.T) {
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	s, err := db.addScript(Script{Name: "name", Script: "first"}, "alice", "Initial")
+	if err == nil {
+		s.Script = "second"
+		err = db.updateScript(s, "bob", "Change")
+	}
+	if err == nil {
+		err = db.rollbackScript(s, 1, "carol")
+	}
+	if err != nil {
+		t.Fatalf("Modifying the script failed: %v", err)
+	}
+
+	versions, err := db.getScriptVersions(s.Id)
+	if err != nil {
+		t.Fatalf("db.getScriptVersions() error = %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("db.getScriptVersions() returned %d versions, want 3", len(versions))
+	}
+
+	want := []ScriptVersion{
+		{Version: 3, Script: "first", Author: "carol", Message: "Rollback to version 1"},
+		{Version: 2, Script: "second", Author: "bob", Message: "Change"},
+		{Version: 1, Script: "first", Author: "alice", Message: "Initial"},
+	}
+	for i := range versions {
+		if versions[i].Date.IsZero() {
+			t.Errorf("Version %d has no date", versions[i].Version)
+		}
+		versions[i].Id = 0
+		versions[i].ScriptId = 0
+		versions[i].Date = time.Time{}
+	}
+	if !reflect.DeepEqual(want, versions) {
+		t.Errorf("db.getScriptVersions() = %v, want %v", versions, want)
+	}
+}
+
 func Test_db_Image(t *testing.T) {
 	at := func(name, comment string) testFunc {
 		return func(d *db) error {
@@ -278,6 +343,10 @@ func Test_db_Image(t *testing.T) {
 		}
 	}
 
+	due := func(y, m, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	}
+
 	cmp := func(t *testing.T, i1, i2 []Image) {
 		for n := range i1 {
 			i1[n].AddDate = time.Time{}
@@ -330,6 +399,23 @@ func Test_db_Image(t *testing.T) {
 			ai(Image{Checksum: "b", Text: "second"}),
 		}, false, nil, &Search{Match: "seco*"},
 			[]Image{Image{Id: 2, Checksum: "b", Text: "second"}}},
+		{"Search the images that need a review", []testOp{
+			ai(Image{Checksum: "a", Text: "good", Confidence: 90, MinConfidence: 80}),
+			ai(Image{Checksum: "b", Text: "bad", Confidence: 30, MinConfidence: 10, NeedsReview: true}),
+		}, false, nil, &Search{Review: true},
+			[]Image{Image{Id: 2, Checksum: "b", Text: "bad", Confidence: 30, MinConfidence: 10, NeedsReview: true}}},
+		{"Search by language", []testOp{
+			ai(Image{Checksum: "a", Text: "lasku", Language: "fi"}),
+			ai(Image{Checksum: "b", Text: "faktura", Language: "sv"}),
+		}, false, nil, &Search{Language: "sv"},
+			[]Image{Image{Id: 2, Checksum: "b", Text: "faktura", Language: "sv"}}},
+		{"Search unpaid bills due in a month", []testOp{
+			ai(Image{Checksum: "a", Invoice: Invoice{Reference: "1232", DueDate: due(2026, 10, 31)}}),
+			ai(Image{Checksum: "b", Invoice: Invoice{Reference: "1232", DueDate: due(2026, 10, 1), Paid: true}}),
+			ai(Image{Checksum: "c", Invoice: Invoice{Reference: "1232", DueDate: due(2026, 11, 1)}}),
+			ai(Image{Checksum: "d", Invoice: Invoice{DueDate: due(2026, 10, 2)}}),
+		}, false, nil, &Search{Unpaid: true, DueFrom: due(2026, 10, 1), DueTo: due(2026, 11, 1)},
+			[]Image{Image{Id: 1, Checksum: "a", Invoice: Invoice{Reference: "1232", DueDate: due(2026, 10, 31)}}}},
 	}
 	for _, tt := range tests {
 		db, err := setupDb()
@@ -454,3 +540,112 @@ func Benchmark_getImages(b *testing.B) {
 		b.Errorf("Database handling failed with: %v", err)
 	}
 }
+
+// The schema of the databases created before the migrations
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS tag (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  name TEXT DEFAULT "" NOT NULL UNIQUE ON CONFLICT ABORT,
+  comment TEXT DEFAULT ""
+);
+
+CREATE TABLE IF NOT EXISTS image (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  checksum TEXT UNIQUE NOT NULL ON CONFLICT ABORT,
+  fileid TEXT DEFAULT "",
+  scandate DATETIME,
+  adddate  DATETIME DEFAULT CURRENT_TIMESTAMP,
+  interpretdate DATETIME,
+  processlog TEXT DEFAULT "",
+  filename TEXT DEFAULT ""
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS imgtext USING fts4 (
+  text DEFAULT "",
+  comment DEFAULT ""
+);
+
+CREATE TABLE IF NOT EXISTS imgtag (
+  tagid INTEGER REFERENCES tag(id) NOT NULL,
+  imgid INTEGER REFERENCES img(id) NOT NULL,
+  UNIQUE (tagid, imgid)
+);
+
+CREATE TABLE IF NOT EXISTS script (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  name TEXT UNIQUE ON CONFLICT ABORT,
+  script TEXT DEFAULT ""
+);
+
+INSERT INTO tag(name, comment) VALUES("bill", "");
+INSERT INTO image(checksum, fileid, scandate, interpretdate, processlog, filename)
+  VALUES("abc", "jpg", "2019-01-02 03:04:05+00:00", "2019-01-02 03:04:05+00:00", "log", "a.jpg");
+INSERT INTO imgtext(rowid, text, comment) VALUES(1, "some text", "");
+INSERT INTO imgtag(tagid, imgid) VALUES(1, 1);
+INSERT INTO script(name, script) VALUES("default", "true");
+`
+
+func Test_db_migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paperless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbfile := filepath.Join(dir, "baseline.sqlite")
+
+	d, err := sqlx.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Exec(baselineSchema)
+	d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening twice migrates only once
+	for i := 0; i < 2; i++ {
+		db, err := openDbFile(dbfile)
+		if err != nil {
+			t.Fatalf("openDbFile() error = %v", err)
+		}
+
+		var version int
+		err = db.Get(&version, "PRAGMA user_version")
+		if err != nil || version != len(dbMigrations) {
+			t.Errorf("Database version = %d, %v, want %d", version, err, len(dbMigrations))
+		}
+
+		img, err := db.getImage(1)
+		if err != nil {
+			t.Errorf("db.getImage() error = %v", err)
+		}
+		if img.Checksum != "abc" || img.Text != "some text" || len(img.Tags) != 1 {
+			t.Errorf("Migrated image not expected: %v", img)
+		}
+
+		s, err := db.getScriptByName("default")
+		if err != nil || s.Version != 1 {
+			t.Errorf("Migrated script = %v, %v, want version 1", s, err)
+		}
+		versions, err := db.getScriptVersions(s.Id)
+		if err != nil || len(versions) != 1 || versions[0].Script != "true" {
+			t.Errorf("Migrated script versions = %v, %v", versions, err)
+		}
+
+		_, err = db.addImage(Image{
+			Checksum: "def" + strconv.Itoa(i),
+			ASN:      i + 1,
+			PHash:    "0123",
+			Tags:     []Tag{{Name: "bill"}},
+		})
+		if err != nil {
+			t.Errorf("db.addImage() error = %v", err)
+		}
+		_, err = db.addImage(Image{Checksum: "ghi" + strconv.Itoa(i), ASN: i + 1})
+		if err == nil {
+			t.Errorf("db.addImage() with a duplicate ASN succeeded")
+		}
+		db.Close()
+	}
+}
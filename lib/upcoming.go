@@ -0,0 +1,122 @@
+package paperless
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateUTC returns the date of the local time at midnight UTC like the due
+// dates are stored
+func dateUTC(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Upcoming returns the images that are not paid and whose due date is
+// within the given days from now or whose reminder starts within them. The
+// images that are past their due date are included until they are paid. The
+// images are ordered by their due dates.
+func Upcoming(db *db, now time.Time, days int) (ret []Image, err error) {
+	today := dateUTC(now)
+	images, err := db.getImages(nil, &Search{NotPaid: true, Due: true})
+	if err != nil {
+		return
+	}
+
+	until := today.AddDate(0, 0, days)
+	ret = []Image{}
+	for _, img := range images.Images {
+		if !img.DueDate.AddDate(0, 0, -img.RemindDays).After(until) {
+			ret = append(ret, img)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].DueDate.Before(ret[j].DueDate)
+	})
+	return
+}
+
+// imageTitle returns the first line of the text of the image or its file
+// name
+func imageTitle(img *Image) string {
+	for _, line := range strings.Split(img.Text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	if img.Filename != "" {
+		return img.Filename
+	}
+	return fmt.Sprintf("Image %d", img.Id)
+}
+
+// icsEscape escapes the text value of an iCalendar property
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "").Replace(s)
+}
+
+// icsLine writes the content line folded to 75 octets without splitting
+// UTF-8 characters
+func icsLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xc0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The space of the continuation line is counted
+		limit = 74
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// UpcomingICS creates an iCalendar feed of the due dates of the images. The
+// reminders are alarms before the all-day events. The url is the link to
+// the images in the web interface.
+func UpcomingICS(images []Image, now time.Time, host, url string) []byte {
+	buf := &bytes.Buffer{}
+	line := func(format string, a ...interface{}) {
+		icsLine(buf, fmt.Sprintf(format, a...))
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//paperless//upcoming//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:Paperless deadlines")
+	for i := range images {
+		img := &images[i]
+		summary := imageTitle(img)
+		if img.Amount != 0 {
+			summary = fmt.Sprintf("%s (%d.%02d)", summary, img.Amount/100, img.Amount%100)
+		}
+
+		line("BEGIN:VEVENT")
+		line("UID:image-%d@%s", img.Id, host)
+		line("DTSTAMP:%s", now.UTC().Format("20060102T150405Z"))
+		line("DTSTART;VALUE=DATE:%s", img.DueDate.Format("20060102"))
+		line("DTEND;VALUE=DATE:%s", img.DueDate.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:%s", icsEscape(summary))
+		if url != "" {
+			line("URL:%s/%d", url, img.Id)
+		}
+		if img.Reference != "" || img.CreditorReference != "" {
+			line("DESCRIPTION:%s", icsEscape(strings.TrimSpace(fmt.Sprintf("%s %s %s",
+				img.IBAN, img.Reference, img.CreditorReference))))
+		}
+		if img.RemindDays > 0 {
+			line("BEGIN:VALARM")
+			line("ACTION:DISPLAY")
+			line("DESCRIPTION:%s", icsEscape(summary))
+			line("TRIGGER:-P%dD", img.RemindDays)
+			line("END:VALARM")
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
@@ -0,0 +1,117 @@
+package paperless
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpcoming(t *testing.T) {
+	db, err := setupDb()
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	due := func(y, m, d int) time.Time {
+		return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	}
+	images := []Image{
+		{Checksum: "past", Invoice: Invoice{DueDate: due(2026, 10, 1)}},
+		{Checksum: "later", Invoice: Invoice{DueDate: due(2026, 10, 30)}},
+		{Checksum: "soon", Invoice: Invoice{DueDate: due(2026, 10, 25)}},
+		{Checksum: "paid", Invoice: Invoice{DueDate: due(2026, 10, 20), Paid: true}},
+		{Checksum: "reminded", Invoice: Invoice{DueDate: due(2027, 1, 1)}, RemindDays: 60},
+		{Checksum: "far", Invoice: Invoice{DueDate: due(2027, 1, 1)}},
+		{Checksum: "none"},
+	}
+	for _, img := range images {
+		_, err = db.addImage(img)
+		if err != nil {
+			t.Fatalf("Adding an image failed: %v", err)
+		}
+	}
+
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.Local)
+	tests := []struct {
+		days int
+		want []string
+	}{
+		{0, []string{"past"}},
+		{6, []string{"past", "soon"}},
+		{11, []string{"past", "soon", "later"}},
+		{13, []string{"past", "soon", "later"}},
+		{14, []string{"past", "soon", "later", "reminded"}},
+		{100, []string{"past", "soon", "later", "reminded", "far"}},
+	}
+	for _, tt := range tests {
+		got, err := Upcoming(db, now, tt.days)
+		if err != nil {
+			t.Fatalf("Upcoming() error = %v", err)
+		}
+		names := []string{}
+		for _, img := range got {
+			names = append(names, img.Checksum)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("Upcoming(%d) = %v, want %v", tt.days, names, tt.want)
+		}
+	}
+}
+
+func TestUpcomingICS(t *testing.T) {
+	images := []Image{
+		{Id: 3, Text: "\nSähkölasku, lokakuu\n", RemindDays: 7, Invoice: Invoice{
+			Reference: "1232",
+			DueDate:   time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC),
+			Amount:    12345,
+		}},
+		{Id: 4, Filename: "warranty.jpg", Invoice: Invoice{
+			DueDate: time.Date(2028, 1, 2, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	got := string(UpcomingICS(images, now, "paperless.lan", "http://paperless.lan/api/v1/image"))
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:image-3@paperless.lan\r\n",
+		"DTSTAMP:20261019T120000Z\r\n",
+		"DTSTART;VALUE=DATE:20261031\r\nDTEND;VALUE=DATE:20261101\r\n",
+		"SUMMARY:Sähkölasku\\, lokakuu (123.45)\r\n",
+		"URL:http://paperless.lan/api/v1/image/3\r\n",
+		"DESCRIPTION:1232\r\n",
+		"TRIGGER:-P7D\r\n",
+		"SUMMARY:warranty.jpg\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("UpcomingICS() does not contain %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "BEGIN:VALARM"); n != 1 {
+		t.Errorf("UpcomingICS() has %d alarms, want 1", n)
+	}
+}
+
+func Test_icsLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	icsLine(buf, "SUMMARY:"+strings.Repeat("ä", 50))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("icsLine() folded to %d lines, want 2: %q", len(lines), buf.String())
+	}
+	unfolded := lines[0]
+	for _, l := range lines[1:] {
+		if len(l) > 75 || !strings.HasPrefix(l, " ") {
+			t.Errorf("icsLine() continuation line is invalid: %q", l)
+		}
+		unfolded += l[1:]
+	}
+	if len(lines[0]) > 75 || unfolded != "SUMMARY:"+strings.Repeat("ä", 50) {
+		t.Errorf("icsLine() folded invalidly: %q", buf.String())
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
 )
 
 /// Generic functionality
@@ -23,6 +25,20 @@ func ChecksumFile(path string) (sum string, err error) {
 	return Checksum(data), err
 }
 
+// TextDiff returns a unified diff from text a to text b
+func TextDiff(a, b string) string {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: "Current",
+		ToFile:   "New",
+		Context:  3,
+	}
+
+	ret, _ := difflib.GetUnifiedDiffString(diff)
+	return ret
+}
+
 // MkdirParents creates all parent directories of the given path or returns an
 // error if they couldn't be created
 func MkdirParents(filename string) error {
@@ -38,6 +54,16 @@ func PathAbs(rootdir, path string) string {
 	return filepath.Join(rootdir, path)
 }
 
+// hasString tells if the slice contains the string
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 /// Parallel processing
 
 type Runner struct {
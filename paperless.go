@@ -37,6 +37,14 @@ func main() {
 		fault(err, "Command line parsing failed")
 	}
 
+	if opts.IsSet("cache-purge") {
+		err = paperless.PurgeCache(opts)
+		if err != nil {
+			fault(err, "Purging the cache failed")
+		}
+		return
+	}
+
 	err = paperless.StartWeb(opts)
 	if err != nil {
 		fault(err, "Starting paperless web server failed")